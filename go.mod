@@ -0,0 +1,3 @@
+module github.com/akchonya/loedormbot
+
+go 1.22
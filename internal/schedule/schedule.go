@@ -0,0 +1,513 @@
+// Package schedule parses LOE's "Графік погодинних відключень" page into
+// per-day group outage texts and minutes. It has no I/O and reads no
+// environment: callers describe what to look for in a Parser.
+package schedule
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// AvailableText replaces LOE's "no outage" wording in parsed group text.
+const AvailableText = "буде!!!!"
+
+// GroupInfo is one group's outage sentence for a day, normalized, and its
+// total outage time.
+type GroupInfo struct {
+	Text    string `json:"text"`
+	Minutes int    `json:"minutes"`
+	Queue   int    `json:"queue,omitempty"` // "черга N" next to the group, 0 if none
+}
+
+// Day is one date's parsed schedule, keyed by group label.
+type Day struct {
+	Date string `json:"date"` // yyyy-mm-dd
+	// Region tells apart schedules for the same date, e.g. two deployments
+	// for different areas sharing one state file.
+	Region string               `json:"region,omitempty"`
+	Groups map[string]GroupInfo `json:"groups"`
+	// Updated is the feed's own update time (RFC3339) when the day was
+	// fetched; the parser leaves it empty for the caller to fill in.
+	Updated string `json:"updated,omitempty"`
+	// Images are the <img src> URLs of a section published as a picture
+	// instead of text; only set when no group was found.
+	Images []string `json:"images,omitempty"`
+}
+
+// DefaultAvailablePhrases mark a group as having power all day.
+var DefaultAvailablePhrases = []string{"Електроенергія є"}
+
+// DefaultFooterMarkers start page content that follows the last schedule.
+var DefaultFooterMarkers = []string{"©", "Copyright", "Всі права захищені", "Усі права захищені", "</body>", "<footer"}
+
+// DefaultTerminators end a group's sentence. "<br>" also matches "<br/>"
+// and "<br />".
+var DefaultTerminators = []string{".", ";", "\n", "<br>"}
+
+// Parser holds what to extract from a page and how.
+type Parser struct {
+	Groups           []string // group labels to extract, e.g. "Група 6.1"
+	Region           string   // copied into every Day
+	AvailablePhrases []string // in addition to DefaultAvailablePhrases
+	FooterMarkers    []string // in addition to DefaultFooterMarkers
+	Terminators      []string // in addition to DefaultTerminators
+	StripEmoji       bool     // drop pictographs from group text
+	// Location is the local time zone outage minutes are measured in; nil
+	// means UTC.
+	Location *time.Location
+	// Debugf, when set, receives a trace of the parse.
+	Debugf func(format string, args ...any)
+}
+
+func (p Parser) debugf(format string, args ...any) {
+	if p.Debugf != nil {
+		p.Debugf(format, args...)
+	}
+}
+
+var spaceRun = regexp.MustCompile(`\s+`)
+
+// CollapseSpace decodes non-breaking spaces and squeezes every whitespace run
+// to a single space, so the literal phrases we match (and QuoteMeta'd group
+// names) see the same text however LOE's editor spaced it. A run with a line
+// break in it becomes a single "\n" instead, since a line break can end a
+// group's sentence (see DefaultTerminators).
+func CollapseSpace(body string) string {
+	body = strings.NewReplacer("&nbsp;", " ", "&#160;", " ", "\u00a0", " ").Replace(body)
+	return spaceRun.ReplaceAllStringFunc(body, func(run string) string {
+		if strings.Contains(run, "\n") {
+			return "\n"
+		}
+		return " "
+	})
+}
+
+// ParseDay extracts a single date's groups. Each date is parsed on its own so
+// a malformed section for one day never costs us the other.
+// When the section exists but none of our groups do, present lists the group
+// labels that were there instead. A group text with impossible times is an
+// error.
+func (p Parser) ParseDay(body string, d time.Time) (day Day, present []string, err error) {
+	day = Day{Date: d.Format("2006-01-02"), Region: p.Region, Groups: map[string]GroupInfo{}}
+	dateTitle := d.Format("02.01.2006")
+	p.debugf("looking for date '%s'", dateTitle)
+	section := p.ExtractSection(body, dateTitle)
+	if section == "" {
+		p.debugf("no section found for %s", dateTitle)
+		return day, nil, nil
+	}
+	if p.Debugf != nil {
+		preview := section
+		if len(preview) > 500 {
+			preview = preview[:500]
+		}
+		p.debugf("found section for %s (first 500 chars):\n%s", dateTitle, preview)
+	}
+	for _, g := range p.Groups {
+		txt := ExtractGroupUntil(section, g, append(append([]string{}, DefaultTerminators...), p.Terminators...))
+		if txt == "" {
+			p.debugf("group %s not found in section", g)
+			continue
+		}
+		p.debugf("found group %s: '%s'", g, txt)
+		norm := p.NormalizeText(txt)
+		if err := CheckIntervals(norm); err != nil {
+			return day, nil, fmt.Errorf("%s: %w", g, err)
+		}
+		mins := OutageMinutes(norm, d, p.Location)
+		day.Groups[g] = GroupInfo{Text: norm, Minutes: mins, Queue: ExtractQueue(section, g)}
+	}
+	if len(day.Groups) == 0 {
+		present = GroupLabels(section)
+		day.Images = ExtractImageURLs(section)
+		if len(day.Images) > 0 {
+			p.debugf("no groups for %s, but %d image(s)", dateTitle, len(day.Images))
+		}
+	}
+	return day, present, nil
+}
+
+// GroupLabels lists the distinct "Група X.Y" labels in a section.
+func GroupLabels(section string) []string {
+	present := []string{}
+	seen := map[string]bool{}
+	for _, g := range regexp.MustCompile(`Група\s+\d+\.\d+`).FindAllString(section, -1) {
+		if !seen[g] {
+			seen[g] = true
+			present = append(present, g)
+		}
+	}
+	return present
+}
+
+// outageRe matches one "з HH:MM до HH:MM" window (H:MM is accepted too).
+var outageRe = regexp.MustCompile(`з\s+(\d{1,2}):(\d{2})\s+до\s+(\d{1,2}):(\d{2})`)
+
+// CheckIntervals rejects "з HH:MM до HH:MM" pairs that are not real clock
+// times, which usually means the section is garbled.
+func CheckIntervals(text string) error {
+	for _, m := range outageRe.FindAllStringSubmatch(text, -1) {
+		if len(m) != 5 {
+			return fmt.Errorf("malformed interval %q", m[0])
+		}
+		for _, hm := range [][2]string{{m[1], m[2]}, {m[3], m[4]}} {
+			h, err1 := strconv.Atoi(hm[0])
+			mm, err2 := strconv.Atoi(hm[1])
+			if err1 != nil || err2 != nil || h > 24 || mm > 59 || (h == 24 && mm != 0) {
+				return fmt.Errorf("invalid time %s:%s in %q", hm[0], hm[1], text)
+			}
+		}
+	}
+	return nil
+}
+
+// ExtractSection grabs text between the date title and the next date title or end.
+// The next title ends the section even if its date is malformed, so one
+// garbled header cannot spill into another day's groups.
+func (p Parser) ExtractSection(body, dateTitle string) string {
+	// Try with HTML tags first (e.g., <b>Графік погодинних відключень на 12.12.2025</b>)
+	pat := regexp.MustCompile(`(?s)<b>Графік погодинних відключень на\s+` + regexp.QuoteMeta(dateTitle) + `</b>(.*?)(?:<b>\s*Графік погодинних відключень на|$)`)
+	m := pat.FindStringSubmatch(body)
+	if len(m) >= 2 {
+		return p.TrimFooter(m[1])
+	}
+	// Fallback: try without HTML tags
+	pat2 := regexp.MustCompile(`(?s)Графік погодинних відключень на\s+` + regexp.QuoteMeta(dateTitle) + `(.*?)(?:Графік погодинних відключень на|$)`)
+	m2 := pat2.FindStringSubmatch(body)
+	if len(m2) >= 2 {
+		return p.TrimFooter(m2[1])
+	}
+	return ""
+}
+
+// TrimFooter cuts a section at the first footer marker, so the last day on
+// the page doesn't swallow trailing copyright or navigation text.
+func (p Parser) TrimFooter(section string) string {
+	markers := append(append([]string{}, DefaultFooterMarkers...), p.FooterMarkers...)
+	for _, m := range markers {
+		if m = strings.TrimSpace(m); m == "" {
+			continue
+		}
+		if i := strings.Index(section, m); i >= 0 {
+			section = section[:i]
+		}
+	}
+	return section
+}
+
+// ExtractGroup finds the first sentence after the group label, ended by one
+// of DefaultTerminators.
+func ExtractGroup(section, group string) string {
+	return ExtractGroupUntil(section, group, DefaultTerminators)
+}
+
+// ExtractGroupUntil is ExtractGroup with its own terminator set. The label's
+// own sentence ("Група 6.1.") runs to the first terminator; the group text is
+// the next non-empty sentence, without its terminator. A sentence with no
+// terminator after it is not taken, so a cut-off section yields "".
+func ExtractGroupUntil(section, group string, terms []string) string {
+	loc := regexp.MustCompile(regexp.QuoteMeta(group)).FindStringIndex(section)
+	if loc == nil {
+		return ""
+	}
+	term := terminatorRe(terms)
+	rest := section[loc[1]:]
+	m := term.FindStringIndex(rest)
+	if m == nil {
+		return ""
+	}
+	rest = rest[m[1]:]
+	for {
+		m := term.FindStringIndex(rest)
+		if m == nil {
+			return ""
+		}
+		if txt := strings.TrimSpace(rest[:m[0]]); txt != "" {
+			return txt
+		}
+		rest = rest[m[1]:]
+	}
+}
+
+// terminatorRe matches any of terms; "<br>" stands for every <br> spelling.
+func terminatorRe(terms []string) *regexp.Regexp {
+	var alts []string
+	for _, t := range terms {
+		switch {
+		case t == "":
+		case strings.EqualFold(t, "<br>"):
+			alts = append(alts, `<br\s*/?>`)
+		default:
+			alts = append(alts, regexp.QuoteMeta(t))
+		}
+	}
+	if len(alts) == 0 {
+		return terminatorRe(DefaultTerminators)
+	}
+	return regexp.MustCompile(`(?i)` + strings.Join(alts, "|"))
+}
+
+var imgSrcRe = regexp.MustCompile(`(?i)<img\b[^>]*?\bsrc\s*=\s*["']([^"']+)["']`)
+
+// ExtractImageURLs lists the distinct <img src> values in a section, in page
+// order, as written (possibly relative).
+func ExtractImageURLs(section string) []string {
+	var urls []string
+	seen := map[string]bool{}
+	for _, m := range imgSrcRe.FindAllStringSubmatch(section, -1) {
+		if len(m) < 2 {
+			continue
+		}
+		src := strings.ReplaceAll(strings.TrimSpace(m[1]), "&amp;", "&")
+		if src != "" && !seen[src] {
+			seen[src] = true
+			urls = append(urls, src)
+		}
+	}
+	return urls
+}
+
+var queueRe = regexp.MustCompile(`(?i)черга\s*№?\s*(\d+)`)
+
+// ExtractQueue returns the queue number ("черга 3") given in group's label or
+// sentence, or 0 when there is none.
+func ExtractQueue(section, group string) int {
+	pat := regexp.MustCompile(regexp.QuoteMeta(group) + `[^\.]*\.?\s*[^\.]*`)
+	m := queueRe.FindStringSubmatch(pat.FindString(section))
+	if len(m) < 2 {
+		return 0
+	}
+	n, _ := strconv.Atoi(m[1])
+	return n
+}
+
+// NormalizeText turns a group's raw sentence into the stored text:
+// AvailableText for "no outage", otherwise the sentence with canonical times.
+func (p Parser) NormalizeText(s string) string {
+	if p.StripEmoji {
+		s = StripEmoji(s)
+	}
+	s = strings.TrimSpace(s)
+	s = strings.TrimPrefix(s, "—")
+	s = strings.TrimSpace(s)
+	s = strings.ReplaceAll(s, "\u00a0", " ")
+	s = strings.ReplaceAll(s, "  ", " ")
+	if p.IsAvailable(s) {
+		return AvailableText
+	}
+	s = strings.TrimSpace(strings.TrimSuffix(s, "."))
+	return CanonicalTimes(s)
+}
+
+// StripEmoji drops pictographs (and their joiners, variation selectors and
+// skin-tone modifiers) that LOE sometimes puts in the schedule text.
+func StripEmoji(s string) string {
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case unicode.Is(unicode.So, r),
+			r == '\u200d',                  // zero-width joiner
+			r >= '\ufe00' && r <= '\ufe0f', // variation selectors
+			r >= 0x1f3fb && r <= 0x1f3ff:   // skin tones
+			return -1
+		}
+		return r
+	}, s)
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// IsAvailable reports whether s is LOE's "no outage" wording.
+func (p Parser) IsAvailable(s string) bool {
+	for _, phrase := range append(append([]string{}, DefaultAvailablePhrases...), p.AvailablePhrases...) {
+		if phrase = strings.TrimSpace(phrase); phrase != "" && strings.Contains(s, phrase) {
+			return true
+		}
+	}
+	return false
+}
+
+// CanonicalTimes rewrites clock times as zero-padded HH:MM, dropping seconds,
+// so "8:00" and "08:00:00" both become "08:00".
+func CanonicalTimes(s string) string {
+	re := regexp.MustCompile(`\b(\d{1,2}):(\d{2})(?::\d{2})?\b`)
+	return re.ReplaceAllStringFunc(s, func(t string) string {
+		m := re.FindStringSubmatch(t)
+		if len(m) < 3 {
+			return t
+		}
+		h, _ := strconv.Atoi(m[1])
+		return fmt.Sprintf("%02d:%s", h, m[2])
+	})
+}
+
+// OutageMinutes returns the real total length of every outage window in text
+// on date in loc, so a window spanning a DST switch is an hour shorter or
+// longer than it reads. A window ending before it starts runs past midnight,
+// as in ParseIntervals.
+func OutageMinutes(text string, date time.Time, loc *time.Location) int {
+	// expect "немає з HH:MM до HH:MM", possibly several joined by "та"
+	if loc == nil {
+		loc = time.UTC
+	}
+	y, mon, d := date.Date()
+	at := func(day int, hh, mm string) time.Time {
+		h, _ := strconv.Atoi(hh)
+		mi, _ := strconv.Atoi(mm)
+		return time.Date(y, mon, day, h, mi, 0, 0, loc)
+	}
+	total := 0
+	for _, m := range outageRe.FindAllStringSubmatch(text, -1) {
+		if len(m) != 5 {
+			continue
+		}
+		start, end := at(d, m[1], m[2]), at(d, m[3], m[4])
+		if end.Before(start) {
+			// "з 23:00 до 01:30" runs past midnight into the next day.
+			end = at(d+1, m[3], m[4])
+		}
+		total += int(end.Sub(start).Minutes())
+	}
+	return total
+}
+
+// Interval is an outage window in minutes since midnight. End is 1440 for a
+// window to midnight and past it for one that runs into the next day.
+type Interval struct {
+	Start, End int
+}
+
+var intervalRe = regexp.MustCompile(`(\d{1,2}):(\d{2})\s*(?:до|–|—|-)\s*(\d{1,2}):(\d{2})`)
+
+// ParseIntervals finds every "з HH:MM до HH:MM" (or "HH:MM–HH:MM") window in
+// a group's text. A window that ends before it starts runs past midnight:
+// "з 23:00 до 01:30" is 23:00 to 25:30, as OutageMinutes counts it.
+func ParseIntervals(text string) []Interval {
+	var out []Interval
+	for _, m := range intervalRe.FindAllStringSubmatch(text, -1) {
+		if len(m) != 5 {
+			continue
+		}
+		h1, _ := strconv.Atoi(m[1])
+		m1, _ := strconv.Atoi(m[2])
+		h2, _ := strconv.Atoi(m[3])
+		m2, _ := strconv.Atoi(m[4])
+		iv := Interval{Start: h1*60 + m1, End: h2*60 + m2}
+		if iv.End < iv.Start {
+			iv.End += 24 * 60
+		}
+		out = append(out, iv)
+	}
+	return out
+}
+
+// TruncateIntervals cuts text after its first n windows and returns how many
+// windows were dropped; text comes back unchanged if it has n or fewer.
+func TruncateIntervals(text string, n int) (string, int) {
+	locs := intervalRe.FindAllStringIndex(text, -1)
+	if n <= 0 || len(locs) <= n {
+		return text, 0
+	}
+	return strings.TrimRight(text[:locs[n-1][1]], " ,;"), len(locs) - n
+}
+
+// IntervalSet returns the windows in text sorted and de-duplicated, so the
+// same schedule listed in a different order compares equal.
+func IntervalSet(text string) []Interval {
+	ivs := ParseIntervals(text)
+	sort.Slice(ivs, func(i, j int) bool {
+		if ivs[i].Start != ivs[j].Start {
+			return ivs[i].Start < ivs[j].Start
+		}
+		return ivs[i].End < ivs[j].End
+	})
+	out := ivs[:0]
+	for i, iv := range ivs {
+		if i == 0 || iv != ivs[i-1] {
+			out = append(out, iv)
+		}
+	}
+	return out
+}
+
+// MergeIntervals joins overlapping or touching windows.
+func MergeIntervals(ivs []Interval) []Interval {
+	var out []Interval
+	for _, iv := range ivs {
+		if n := len(out); n > 0 && iv.Start <= out[n-1].End {
+			if iv.End > out[n-1].End {
+				out[n-1].End = iv.End
+			}
+			continue
+		}
+		out = append(out, iv)
+	}
+	return out
+}
+
+// LongestOutage returns the longest continuous outage in text, in minutes.
+func LongestOutage(text string) int {
+	longest := 0
+	for _, iv := range MergeIntervals(IntervalSet(text)) {
+		if d := iv.End - iv.Start; d > longest {
+			longest = d
+		}
+	}
+	return longest
+}
+
+// SameSchedule compares two group texts by their interval sets, falling back
+// to the text itself when either has no parsable windows.
+func SameSchedule(a, b string) bool {
+	ia, ib := IntervalSet(a), IntervalSet(b)
+	if len(ia) == 0 || len(ib) == 0 {
+		return a == b
+	}
+	if len(ia) != len(ib) {
+		return false
+	}
+	for i := range ia {
+		if ia[i] != ib[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// LatestHeader returns the newest date among the page's schedule headers.
+func LatestHeader(body string) (time.Time, bool) {
+	re := regexp.MustCompile(`Графік погодинних відключень на\s+(\d{2}\.\d{2}\.\d{4})`)
+	var latest time.Time
+	for _, m := range re.FindAllStringSubmatch(body, -1) {
+		if len(m) < 2 {
+			continue
+		}
+		t, err := time.Parse("02.01.2006", m[1])
+		if err == nil && t.After(latest) {
+			latest = t
+		}
+	}
+	return latest, !latest.IsZero()
+}
+
+// FormatDuration renders minutes as "2 год 15 хв", "45 хв" or "3 год".
+func FormatDuration(mins int) string {
+	h, m := mins/60, mins%60
+	switch {
+	case h == 0:
+		return fmt.Sprintf("%d хв", m)
+	case m == 0:
+		return fmt.Sprintf("%d год", h)
+	default:
+		return fmt.Sprintf("%d год %d хв", h, m)
+	}
+}
+
+// ToDM turns "2025-12-12" into "12.12".
+func ToDM(date string) string {
+	t, _ := time.Parse("2006-01-02", date)
+	return t.Format("02.01")
+}
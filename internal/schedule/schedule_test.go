@@ -0,0 +1,357 @@
+package schedule
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const page = `<p><b>Графік погодинних відключень на 12.12.2025</b></p>` +
+	`<p>Група 4.1. Електроенергії немає з 8:00 до 12:00.</p>` +
+	`<p>Група 6.1. Електроенергії немає з 14:00:00 до 16:00.</p>` +
+	`<p><b>Графік погодинних відключень на 13.12.2025</b></p>` +
+	`<p>Група 6.1. Електроенергія є.</p>` +
+	`<p>Група 4.1. Електроенергії немає з 10:00 до 11:00.</p>` +
+	`<p>© LOE</p><p>Група 6.1. Електроенергії немає з 00:00 до 24:00.</p>`
+
+func TestCheckIntervals(t *testing.T) {
+	tests := []struct {
+		in      string
+		wantErr bool
+	}{
+		{"з 08:00 до 12:00", false},
+		{"з 22:00 до 24:00", false},
+		{"з 22:00 до 24:30", true},
+		{"з 08:60 до 09:00", true},
+		{"буде!!!!", false},
+	}
+	for _, tt := range tests {
+		if err := CheckIntervals(tt.in); (err != nil) != tt.wantErr {
+			t.Errorf("CheckIntervals(%q) = %v, want error %v", tt.in, err, tt.wantErr)
+		}
+	}
+}
+
+func TestParseDay(t *testing.T) {
+	p := Parser{Groups: []string{"Група 6.1", "Група 4.1"}, Region: "lviv"}
+	tests := []struct {
+		name    string
+		body    string
+		date    string
+		want    map[string]GroupInfo
+		present []string
+		images  []string
+		wantErr string
+	}{
+		{
+			name: "outage",
+			body: page,
+			date: "2025-12-12",
+			want: map[string]GroupInfo{
+				"Група 6.1": {Text: "Електроенергії немає з 14:00 до 16:00", Minutes: 120},
+				"Група 4.1": {Text: "Електроенергії немає з 08:00 до 12:00", Minutes: 240},
+			},
+		},
+		{
+			name: "available",
+			body: page,
+			date: "2025-12-13",
+			want: map[string]GroupInfo{
+				"Група 6.1": {Text: AvailableText},
+				"Група 4.1": {Text: "Електроенергії немає з 10:00 до 11:00", Minutes: 60},
+			},
+		},
+		{name: "missing date", body: page, date: "2025-12-14", want: map[string]GroupInfo{}},
+		{
+			name: "footer cut",
+			body: `<b>Графік погодинних відключень на 12.12.2025</b><p>Група 4.1. Електроенергії немає з 10:00 до 11:00.</p><p>© LOE</p><p>Група 6.1. Електроенергії немає з 00:00 до 24:00.</p>`,
+			date: "2025-12-12",
+			want: map[string]GroupInfo{"Група 4.1": {Text: "Електроенергії немає з 10:00 до 11:00", Minutes: 60}},
+		},
+		{
+			name:    "other groups only",
+			body:    `<b>Графік погодинних відключень на 12.12.2025</b><p>Група 1.1. Електроенергії немає з 08:00 до 09:00.</p><p>Група 1.1. x.</p>`,
+			date:    "2025-12-12",
+			want:    map[string]GroupInfo{},
+			present: []string{"Група 1.1"},
+		},
+		{
+			name:    "published as a picture",
+			body:    `<b>Графік погодинних відключень на 12.12.2025</b><img src="/a.png?x=1&amp;y=2"><img src='/a.png?x=1&amp;y=2'>`,
+			date:    "2025-12-12",
+			want:    map[string]GroupInfo{},
+			present: []string{},
+			images:  []string{"/a.png?x=1&y=2"},
+		},
+		{
+			name:    "impossible time",
+			body:    `<b>Графік погодинних відключень на 12.12.2025</b><p>Група 6.1. Електроенергії немає з 25:00 до 26:00.</p>`,
+			date:    "2025-12-12",
+			wantErr: "Група 6.1: invalid time 25:00",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, _ := time.Parse("2006-01-02", tt.date)
+			day, present, err := p.ParseDay(tt.body, d)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("err = %v", err)
+			}
+			if day.Date != tt.date || day.Region != "lviv" {
+				t.Errorf("day = %s/%s", day.Date, day.Region)
+			}
+			if !reflect.DeepEqual(day.Groups, tt.want) {
+				t.Errorf("groups = %#v, want %#v", day.Groups, tt.want)
+			}
+			if !reflect.DeepEqual(present, tt.present) {
+				t.Errorf("present = %q, want %q", present, tt.present)
+			}
+			if !reflect.DeepEqual(day.Images, tt.images) {
+				t.Errorf("images = %q, want %q", day.Images, tt.images)
+			}
+		})
+	}
+}
+
+func TestNormalizeText(t *testing.T) {
+	tests := []struct {
+		name    string
+		phrases []string
+		strip   bool
+		in      string
+		want    string
+	}{
+		{name: "times and dot", in: " — Електроенергії немає з 8:00 до 9:30:00. ", want: "Електроенергії немає з 08:00 до 09:30"},
+		{name: "nbsp", in: "немає з 08:00 до 09:00", want: "немає з 08:00 до 09:00"},
+		{name: "available", in: "Електроенергія є.", want: AvailableText},
+		{name: "extra phrase", phrases: []string{"Світло буде", " "}, in: "Світло буде весь день", want: AvailableText},
+		{name: "no extra phrases", in: "Світло буде весь день", want: "Світло буде весь день"},
+		{name: "emoji kept", in: "⚡ немає з 08:00 до 09:00", want: "⚡ немає з 08:00 до 09:00"},
+		{name: "emoji stripped", strip: true, in: "⚡️ немає з 08:00 до 09:00", want: "немає з 08:00 до 09:00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := Parser{AvailablePhrases: tt.phrases, StripEmoji: tt.strip}
+			if got := p.NormalizeText(tt.in); got != tt.want {
+				t.Errorf("normalizeText(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLatestHeader(t *testing.T) {
+	tests := []struct {
+		body string
+		want string
+	}{
+		{page, "2025-12-13"},
+		{"Графік погодинних відключень на 31.12.2025 Графік погодинних відключень на 01.01.2026", "2026-01-01"},
+		{"нічого", ""},
+	}
+	for _, tt := range tests {
+		d, ok := LatestHeader(tt.body)
+		if got := d.Format("2006-01-02"); ok != (tt.want != "") || (ok && got != tt.want) {
+			t.Errorf("LatestHeader = %s, %v; want %q", got, ok, tt.want)
+		}
+	}
+}
+
+func TestIntervals(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		want    []Interval
+		merged  []Interval
+		longest int
+	}{
+		{
+			name:    "unordered with duplicate",
+			text:    "з 14:00 до 16:00, з 08:00 до 10:00, з 14:00 до 16:00",
+			want:    []Interval{{480, 600}, {840, 960}},
+			merged:  []Interval{{480, 600}, {840, 960}},
+			longest: 120,
+		},
+		{
+			name:    "touching and overlapping",
+			text:    "08:00–10:00, 10:00-11:00, з 10:30 до 12:00",
+			want:    []Interval{{480, 600}, {600, 660}, {630, 720}},
+			merged:  []Interval{{480, 720}},
+			longest: 240,
+		},
+		{
+			name:    "runs to midnight",
+			text:    "з 22:00 до 00:00",
+			want:    []Interval{{1320, 1440}},
+			merged:  []Interval{{1320, 1440}},
+			longest: 120,
+		},
+		{
+			name:    "past midnight",
+			text:    "з 23:00 до 01:30",
+			want:    []Interval{{1380, 1530}},
+			merged:  []Interval{{1380, 1530}},
+			longest: 150,
+		},
+		{name: "none", text: "буде!!!!"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IntervalSet(tt.text); len(got) != len(tt.want) || (len(got) > 0 && !reflect.DeepEqual(got, tt.want)) {
+				t.Errorf("IntervalSet = %v, want %v", got, tt.want)
+			}
+			if got := MergeIntervals(IntervalSet(tt.text)); len(got) != len(tt.merged) || (len(got) > 0 && !reflect.DeepEqual(got, tt.merged)) {
+				t.Errorf("MergeIntervals = %v, want %v", got, tt.merged)
+			}
+			if got := LongestOutage(tt.text); got != tt.longest {
+				t.Errorf("LongestOutage = %d, want %d", got, tt.longest)
+			}
+		})
+	}
+}
+
+func TestSameSchedule(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"немає з 08:00 до 10:00 та з 14:00 до 16:00", "Світла немає з 14:00 до 16:00, з 08:00 до 10:00", true},
+		{"з 08:00 до 10:00", "з 08:00 до 10:30", false},
+		{"з 08:00 до 10:00", "з 08:00 до 10:00 та з 12:00 до 13:00", false},
+		{"буде!!!!", "буде!!!!", true},
+		{"буде!!!!", "з 08:00 до 10:00", false},
+	}
+	for _, tt := range tests {
+		if got := SameSchedule(tt.a, tt.b); got != tt.want {
+			t.Errorf("SameSchedule(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestFormatDuration(t *testing.T) {
+	tests := []struct {
+		mins int
+		want string
+	}{
+		{45, "45 хв"},
+		{180, "3 год"},
+		{135, "2 год 15 хв"},
+		{0, "0 хв"},
+	}
+	for _, tt := range tests {
+		if got := FormatDuration(tt.mins); got != tt.want {
+			t.Errorf("FormatDuration(%d) = %q, want %q", tt.mins, got, tt.want)
+		}
+	}
+}
+
+func TestOutageMinutes(t *testing.T) {
+	tests := []struct {
+		date, text string
+		want       int
+	}{
+		{"2025-12-12", "немає з 08:00 до 12:30", 270},
+		{"2026-03-29", "немає з 02:00 до 05:00", 120}, // clocks go forward at 03:00
+		{"2025-10-26", "немає з 02:00 до 05:00", 240}, // clocks go back at 04:00
+		{"2026-03-29", "немає з 08:00 до 12:00", 240},
+		{"2025-12-12", "немає з 23:00 до 01:30", 150},
+		{"2025-12-12", "немає з 08:00 до 10:00 та з 12:00 до 13:30", 210},
+		{"2025-12-12", "немає з 08:00 до 10:00, з 22:00 до 24:00", 240},
+		{"2025-10-25", "немає з 23:00 до 05:00", 420}, // the next night is an hour longer
+	}
+	kyiv, err := time.LoadLocation("Europe/Kyiv")
+	if err != nil {
+		t.Skip(err)
+	}
+	for _, tt := range tests {
+		d, _ := time.Parse("2006-01-02", tt.date)
+		if got := OutageMinutes(tt.text, d, kyiv); got != tt.want {
+			t.Errorf("OutageMinutes(%q, %s) = %d, want %d", tt.text, tt.date, got, tt.want)
+		}
+	}
+}
+
+func TestCollapseSpace(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"Група&nbsp;6.1.", "Група 6.1."},
+		{"Група&#160;6.1.", "Група 6.1."},
+		{"Група  6.1.", "Група 6.1."},
+		{"немає  з\t8:00 до 12:00", "немає з 8:00 до 12:00"},
+		{"Група 6.1. \r\n\n  немає", "Група 6.1.\nнемає"},
+	}
+	for _, tt := range tests {
+		if got := CollapseSpace(tt.in); got != tt.want {
+			t.Errorf("CollapseSpace(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestExtractQueue(t *testing.T) {
+	tests := []struct {
+		section string
+		want    int
+	}{
+		{"Група 6.1 (черга 3). немає з 08:00 до 09:00.", 3},
+		{"Група 6.1. Черга №2, немає з 08:00 до 09:00.", 2},
+		{"Група 6.1. немає з 08:00 до 09:00. Група 6.2 (черга 5).", 0},
+		{"Група 4.1 (черга 1).", 0},
+	}
+	for _, tt := range tests {
+		if got := ExtractQueue(tt.section, "Група 6.1"); got != tt.want {
+			t.Errorf("ExtractQueue(%q) = %d, want %d", tt.section, got, tt.want)
+		}
+	}
+}
+
+func TestTruncateIntervals(t *testing.T) {
+	text := "з 08:00 до 09:00, з 10:00 до 11:00, з 12:00 до 13:00"
+	tests := []struct {
+		n       int
+		want    string
+		dropped int
+	}{
+		{0, text, 0},
+		{1, "з 08:00 до 09:00", 2},
+		{2, "з 08:00 до 09:00, з 10:00 до 11:00", 1},
+		{3, text, 0},
+	}
+	for _, tt := range tests {
+		got, dropped := TruncateIntervals(text, tt.n)
+		if got != tt.want || dropped != tt.dropped {
+			t.Errorf("TruncateIntervals(%d) = %q, %d; want %q, %d", tt.n, got, dropped, tt.want, tt.dropped)
+		}
+	}
+}
+
+func TestExtractGroupUntil(t *testing.T) {
+	tests := []struct {
+		name    string
+		section string
+		terms   []string
+		want    string
+	}{
+		{name: "sentence", section: "Група 6.1. немає з 08:00 до 09:00. Група 6.2.", want: "немає з 08:00 до 09:00"},
+		{name: "br", section: "Група 6.1<br/>немає з 08:00 до 09:00<BR />", want: "немає з 08:00 до 09:00"},
+		{name: "empty sentences skipped", section: "Група 6.1. . ; текст.", want: "текст"},
+		{name: "cut off", section: "Група 6.1. немає з 08:00", want: ""},
+		{name: "missing", section: "Група 4.1. текст.", want: ""},
+		{name: "custom terminator", section: "Група 6.1| текст|", terms: []string{"|"}, want: "текст"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			terms := tt.terms
+			if terms == nil {
+				terms = DefaultTerminators
+			}
+			if got := ExtractGroupUntil(tt.section, "Група 6.1", terms); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
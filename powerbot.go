@@ -1,452 +1,4657 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
 	"io"
+	"io/fs"
+	"math"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/smtp"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
 	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
 	"time"
+
+	"github.com/akchonya/loedormbot/internal/schedule"
 )
 
 const (
-	statePathEnv = "POWERBOT_STATE"
-	testFileEnv  = "POWERBOT_TEST_FILE"
-	tokenEnv     = "POWERBOT_TOKEN"
-	chatIDEnv    = "POWERBOT_CHAT_ID"
-	debugEnv     = "POWERBOT_DEBUG"
-	fetchURL     = "https://api.loe.lviv.ua/api/menus?page=1&type=photo-grafic"
-	defaultState = "/var/lib/powerbot/state.json"
-	kyivTZ       = "Europe/Kyiv"
-	groupWater   = "Група 4.1"
-	groupPower   = "Група 6.1"
-	labelWater   = "*💧 води не буде*"
-	labelPower   = "*💡 світла не буде*"
+	statePathEnv           = "POWERBOT_STATE"
+	stateCompactEnv        = "POWERBOT_STATE_COMPACT"
+	stateFormatEnv         = "POWERBOT_STATE_FORMAT"
+	stateFallbackEnv       = "POWERBOT_STATE_FALLBACK"
+	testFileEnv            = "POWERBOT_TEST_FILE"
+	testJSONEnv            = "POWERBOT_TEST_JSON"
+	tokenEnv               = "POWERBOT_TOKEN"
+	chatIDEnv              = "POWERBOT_CHAT_ID"
+	chatTokensEnv          = "POWERBOT_CHAT_TOKENS"
+	botEnv                 = "POWERBOT_BOT"
+	telegramRetriesEnv     = "POWERBOT_TELEGRAM_RETRIES"
+	httpTimeoutEnv         = "POWERBOT_HTTP_TIMEOUT"
+	maxIdlePerHostEnv      = "POWERBOT_MAX_IDLE_CONNS_PER_HOST"
+	idleConnTimeoutEnv     = "POWERBOT_IDLE_CONN_TIMEOUT"
+	proxyEnv               = "POWERBOT_PROXY"
+	fetchProxyEnv          = "POWERBOT_FETCH_PROXY"
+	fetchURLEnv            = "POWERBOT_FETCH_URL"
+	maxPagesEnv            = "POWERBOT_MAX_PAGES"
+	dumpHTMLEnv            = "POWERBOT_DUMP_HTML"
+	dumpKeepEnv            = "POWERBOT_DUMP_KEEP"
+	daemonIntervalEnv      = "POWERBOT_DAEMON_INTERVAL"
+	pidFileEnv             = "POWERBOT_PID_FILE"
+	startupDelayEnv        = "POWERBOT_STARTUP_DELAY"
+	debugChatEnv           = "POWERBOT_DEBUG_CHAT_ID"
+	adminChatEnv           = "POWERBOT_ADMIN_CHAT_ID"
+	parseAlertDaysEnv      = "POWERBOT_PARSE_ALERT_DAYS"
+	debugEnv               = "POWERBOT_DEBUG"
+	logFormatEnv           = "POWERBOT_LOG_FORMAT"
+	dryRunEnv              = "POWERBOT_DRY_RUN"
+	dryRunNoSaveEnv        = "POWERBOT_DRY_RUN_NO_SAVE"
+	groupsEnv              = "POWERBOT_GROUPS"
+	lookaheadEnv           = "POWERBOT_LOOKAHEAD_DAYS"
+	parseConcurrencyEnv    = "POWERBOT_PARSE_CONCURRENCY"
+	maxFutureEnv           = "POWERBOT_MAX_FUTURE_DAYS"
+	groupAliasesEnv        = "POWERBOT_GROUP_ALIASES"
+	regionEnv              = "POWERBOT_REGION"
+	availablePhrasesEnv    = "POWERBOT_AVAILABLE_PHRASES"
+	notFoundEnv            = "POWERBOT_NOT_FOUND_TEXT"
+	minutesToleranceEnv    = "POWERBOT_MINUTES_TOLERANCE"
+	severeMinutesEnv       = "POWERBOT_SEVERE_MINUTES"
+	zeroTransitionsEnv     = "POWERBOT_NOTIFY_ZERO_TRANSITIONS_ONLY"
+	addedNeutralEnv        = "POWERBOT_ADDED_GROUP_NEUTRAL"
+	dailyDigestEnv         = "POWERBOT_DAILY_DIGEST"
+	digestAtEnv            = "POWERBOT_DIGEST_AT"
+	digestBreakthroughEnv  = "POWERBOT_DIGEST_BREAKTHROUGH"
+	weeklySummaryEnv       = "POWERBOT_WEEKLY_SUMMARY_AT"
+	footerMarkersEnv       = "POWERBOT_FOOTER_MARKERS"
+	terminatorsEnv         = "POWERBOT_GROUP_TERMINATORS"
+	compactEnv             = "POWERBOT_COMPACT"
+	imageEnv               = "POWERBOT_IMAGE"
+	stripEmojiEnv          = "POWERBOT_STRIP_EMOJI"
+	combineSameEnv         = "POWERBOT_COMBINE_SAME"
+	combineDaysEnv         = "POWERBOT_COMBINE_DAYS"
+	celebrateEnv           = "POWERBOT_CELEBRATE_AVAILABLE"
+	countdownPinEnv        = "POWERBOT_COUNTDOWN_PIN"
+	pinAllDaysEnv          = "POWERBOT_PIN_ALL_DAYS"
+	replyThreadEnv         = "POWERBOT_REPLY_THREAD"
+	showLongestEnv         = "POWERBOT_SHOW_LONGEST"
+	maxIntervalsEnv        = "POWERBOT_MAX_INTERVALS"
+	sourceAnchorEnv        = "POWERBOT_SOURCE_ANCHOR_FORMAT"
+	disablePreviewEnv      = "POWERBOT_DISABLE_PREVIEW"
+	notesFileEnv           = "POWERBOT_NOTES_FILE"
+	messageTemplateEnv     = "POWERBOT_MESSAGE_TEMPLATE"
+	messageTemplateFileEnv = "POWERBOT_MESSAGE_TEMPLATE_FILE"
+	trackSeenEnv           = "POWERBOT_TRACK_SEEN"
+	maxRunEnv              = "POWERBOT_MAX_RUN_DURATION"
+	pingURLEnv             = "POWERBOT_PING_URL"
+	criticalWebhookEnv     = "POWERBOT_CRITICAL_WEBHOOK"
+	criticalMinutesEnv     = "POWERBOT_CRITICAL_MINUTES"
+	breakerMaxEnv          = "POWERBOT_BREAKER_MAX"
+	breakerWindowEnv       = "POWERBOT_BREAKER_WINDOW"
+	pushgatewayEnv         = "POWERBOT_PUSHGATEWAY_URL"
+	metricsAddrEnv         = "POWERBOT_METRICS_ADDR"
+	externalURLEnv         = "POWERBOT_EXTERNAL_URL"
+	lastErrorFileEnv       = "POWERBOT_LAST_ERROR_FILE"
+	errorChatEnv           = "POWERBOT_ERROR_CHAT"
+	errorIntervalEnv       = "POWERBOT_ERROR_INTERVAL"
+	ipcSocketEnv           = "POWERBOT_IPC_SOCKET"
+	queueURLEnv            = "POWERBOT_QUEUE_URL"
+	githubTokenEnv         = "POWERBOT_GITHUB_TOKEN"
+	githubRepoEnv          = "POWERBOT_GITHUB_REPO"
+	githubPathEnv          = "POWERBOT_GITHUB_PATH"
+	githubAPIEnv           = "POWERBOT_GITHUB_API"
+	strictFreshEnv         = "POWERBOT_STRICT_FRESHNESS"
+	refetchEnv             = "POWERBOT_REFETCH_ON_EMPTY"
+	silentFirstRunEnv      = "POWERBOT_SILENT_FIRST_RUN"
+	smtpHostEnv            = "POWERBOT_SMTP_HOST"
+	smtpPortEnv            = "POWERBOT_SMTP_PORT"
+	smtpUserEnv            = "POWERBOT_SMTP_USER"
+	smtpPassEnv            = "POWERBOT_SMTP_PASS"
+	smtpFromEnv            = "POWERBOT_SMTP_FROM"
+	smtpToEnv              = "POWERBOT_SMTP_TO"
+	defaultFetchURL        = "https://api.loe.lviv.ua/api/menus?page=1&type=photo-grafic"
+	pageURL                = "https://poweron.loe.lviv.ua/"
+	defaultState           = "/var/lib/powerbot/state.json"
+	defaultSMTPPort        = "587"
+	defaultGithubPath      = "schedules/{date}.json"
+	defaultGithubAPI       = "https://api.github.com"
+	pingTimeout            = 10 * time.Second
+	defaultHTTPTimeout     = 30 * time.Second
+	defaultMaxIdlePerHost  = 4
+	defaultIdleConnTimeout = 5 * time.Minute
+	defaultMaxPages        = 5
+	defaultDumpKeep        = 20
+	defaultBreakerWindow   = time.Hour
+	defaultErrorInterval   = time.Hour
+	defaultParseAlertDays  = 2
+	defaultLookahead       = 1
+	defaultSevereMinutes   = 60
+	defaultMaxFuture       = 7
+	botPollTimeout         = 50 * time.Second
+	botRetryDelay          = 5 * time.Second
+	refetchDelay           = 5 * time.Second
+	defaultTelegramRetries = 3
+	telegramBackoff        = time.Second
+	ipcTimeout             = 2 * time.Second
+	queueTimeout           = 10 * time.Second
+	stateSaveAttempts      = 3
+	stateSaveDelay         = 500 * time.Millisecond
+	kyivTZ                 = "Europe/Kyiv"
+	groupWater             = "Група 4.1"
+	groupPower             = "Група 6.1"
+	labelWater             = "*💧 води не буде*"
+	labelPower             = "*💡 світла не буде*"
+	labelBoth              = "*💡💧 світла і води не буде*"
+	emojiWater             = "💧"
+	emojiPower             = "💡"
+	defaultNotFound        = "н/д"
 )
 
-type GroupInfo struct {
-	Text    string `json:"text"`
-	Minutes int    `json:"minutes"`
+// groupSpec is one watched group and how it is rendered in posts.
+type groupSpec struct {
+	Name  string // label as it appears on the LOE page
+	Label string // MarkdownV2, e.g. "*💡 світла не буде*"
+	Emoji string
 }
 
-type DayInfo struct {
-	Date   string               `json:"date"` // yyyy-mm-dd
-	Groups map[string]GroupInfo `json:"groups"`
+// knownGroups are the groups selectable by key in POWERBOT_GROUPS.
+var knownGroups = map[string]groupSpec{
+	"power": {Name: groupPower, Label: labelPower, Emoji: emojiPower},
+	"water": {Name: groupWater, Label: labelWater, Emoji: emojiWater},
 }
 
+// watched is the configured group list, in posting order.
+var watched = []groupSpec{knownGroups["power"], knownGroups["water"]}
+
+// autoGroups makes each run watch whatever groups today's section lists
+// (POWERBOT_GROUPS=auto).
+var autoGroups bool
+
+// httpClient is used for the LOE fetch, GitHub posts, the healthcheck ping,
+// the Pushgateway and the critical webhook, telegramClient for the Bot API; main sets their timeouts from POWERBOT_HTTP_TIMEOUT and
+// proxies from POWERBOT_FETCH_PROXY and POWERBOT_PROXY. Bot long-polling uses
+// telegramClient's transport without the timeout.
+var (
+	httpClient     = &http.Client{Timeout: defaultHTTPTimeout}
+	telegramClient = &http.Client{Timeout: defaultHTTPTimeout}
+)
+
+// fetchURL is the LOE API endpoint, defaultFetchURL unless POWERBOT_FETCH_URL
+// overrides it.
+var fetchURL = defaultFetchURL
+
+// externalURL is POWERBOT_EXTERNAL_URL without a trailing slash: the base the
+// metrics endpoint is reached at through a reverse proxy, "" if unset.
+var externalURL string
+
+// maxIntervals is POWERBOT_MAX_INTERVALS, read once at startup: how many
+// outage windows a line lists before "(+N ще)", 0 for all of them.
+var maxIntervals int
+
+// dryRun prints posts to stdout instead of sending them (-dry-run or
+// POWERBOT_DRY_RUN); dryRunNoSave also leaves the state file untouched.
+var dryRun, dryRunNoSave bool
+
+// messageTmpl replaces the built-in post layout when set; see
+// loadMessageTemplate.
+var messageTmpl *template.Template
+
+// GroupInfo and DayInfo are the parsed schedule types; see internal/schedule.
+type (
+	GroupInfo = schedule.GroupInfo
+	DayInfo   = schedule.Day
+)
+
 type State struct {
-	Days []DayInfo `json:"days"`
+	// Version is stateVersion when written; 0 means a file from before
+	// versioning, which loads the same.
+	Version int       `json:"version,omitempty"`
+	Days    []DayInfo `json:"days"`
+	// Seen maps chat id -> dayKey -> hash of the schedule that chat last saw.
+	Seen map[string]map[string]string `json:"seen,omitempty"`
+	// Warned lists dayKeys already reported to the debug chat as unrecognized.
+	Warned []string `json:"warned,omitempty"`
+	// Subscriptions maps chat id -> group names, managed via /subscribe.
+	Subscriptions map[string][]string `json:"subscriptions,omitempty"`
+	// Updates tracks recent update posts per dayKey for the circuit breaker.
+	Updates map[string]updateLog `json:"updates,omitempty"`
+	// Posted maps dayKey -> hash of the schedule last posted to the channel.
+	Posted map[string]string `json:"posted,omitempty"`
+	// Escalated lists dayKeys already sent to the critical webhook.
+	Escalated []string `json:"escalated,omitempty"`
+	// Messages maps "date/chat" -> Telegram message id of the latest post for
+	// that date, for POWERBOT_REPLY_THREAD.
+	Messages map[string]int `json:"messages,omitempty"`
+	// Pin is the pinned countdown message, edited every run.
+	Pin *pinState `json:"pin,omitempty"`
+	// LastDigest is the date (YYYY-MM-DD) of the last daily digest.
+	LastDigest string `json:"last_digest,omitempty"`
+	// Totals maps date -> group -> outage minutes of the day's latest
+	// schedule, kept for a week for POWERBOT_WEEKLY_SUMMARY_AT.
+	Totals map[string]map[string]int `json:"totals,omitempty"`
+	// LastWeekly is the date (YYYY-MM-DD) of the last weekly summary.
+	LastWeekly string `json:"last_weekly,omitempty"`
+	// Pages are the API pages of the last fully processed fetch with their
+	// validators, sent back for conditional GETs, and PagesFor the checked
+	// window (see windowKey) they were processed for.
+	Pages    []pageCache `json:"pages,omitempty"`
+	PagesFor string      `json:"pages_for,omitempty"`
+	// SourceUpdated is the feed's updatedAt (RFC3339) from the latest fetch.
+	SourceUpdated string `json:"source_updated,omitempty"`
+	// LastParsed is when (RFC3339) a run last parsed any schedule, and
+	// ParseAlerted whether the admin chat was told parsing looks broken.
+	LastParsed   string `json:"last_parsed,omitempty"`
+	ParseAlerted bool   `json:"parse_alerted,omitempty"`
+}
+
+type updateLog struct {
+	Times   []int64 `json:"times,omitempty"` // unix seconds
+	Tripped bool    `json:"tripped,omitempty"`
 }
 
 func main() {
-	loc, _ := time.LoadLocation(kyivTZ)
-	today := time.Now().In(loc).Truncate(24 * time.Hour)
-	datesToCheck := []time.Time{today, today.AddDate(0, 0, 1)}
-	debug := os.Getenv(debugEnv) != ""
+	simulatePath := flag.String("simulate", "", "replay a scenario `file` with a fake clock and print what would be posted")
+	dryRunFlag := flag.Bool("dry-run", false, "parse and format as usual but print posts to stdout instead of sending them")
+	noSaveFlag := flag.Bool("no-save", false, "with -dry-run, don't write the state file either")
+	correctDate := flag.String("correct", "", "re-post the schedule for `date` (YYYY-MM-DD) as a visible correction")
+	importPath := flag.String("import-state", "", "copy the state file at `path` (JSON or gob) into the POWERBOT_STATE backend and exit")
+	flag.Parse()
 
-	htmlBody, err := loadContent()
-	if err != nil {
-		logf("error fetching: %v", err)
-		return
+	switch v := os.Getenv(logFormatEnv); {
+	case strings.EqualFold(v, "json"):
+		jsonLogs = true
+	case v != "" && !strings.EqualFold(v, "text"):
+		logf("warning: invalid %s %q, logging plain text", logFormatEnv, v)
 	}
-	if debug {
-		logf("debug: fetched %d bytes", len(htmlBody))
+	if _, err := kyivZone(); err != nil {
+		logf("warning: can't load time zone %s (%v); using fixed UTC+2, which is an hour off in summer. Install tzdata (e.g. apk add tzdata) to fix this.", kyivTZ, err)
 	}
 
-	parsed, err := parsePage(htmlBody, datesToCheck)
-	if err != nil {
-		logf("parse error: %v", err)
-		return
-	}
-	logf("parsed %d days (looking for %s and %s)", len(parsed), datesToCheck[0].Format("02.01.2006"), datesToCheck[1].Format("02.01.2006"))
-	if len(parsed) == 0 {
-		logf("warning: no schedules found for today or tomorrow")
-	} else {
-		for _, d := range parsed {
-			logf("found schedule for %s with %d groups", d.Date, len(d.Groups))
-			for k, v := range d.Groups {
-				logf("  %s => %s (mins=%d)", k, v.Text, v.Minutes)
-			}
+	if v := os.Getenv(httpTimeoutEnv); v != "" {
+		if d, err := time.ParseDuration(v); err != nil || d <= 0 {
+			logf("warning: invalid %s %q, using %s", httpTimeoutEnv, v, defaultHTTPTimeout)
+		} else {
+			httpClient.Timeout = d
+			telegramClient.Timeout = d
 		}
 	}
-
-	statePath := os.Getenv(statePathEnv)
-	if statePath == "" {
-		statePath = defaultState
-	}
-	st, err := loadState(statePath)
-	if debug && err != nil {
-		logf("debug: loadState error (non-fatal): %v", err)
-	}
-
-	token := os.Getenv(tokenEnv)
-	chatID := os.Getenv(chatIDEnv)
-	if token == "" || chatID == "" {
-		logf("warning: POWERBOT_TOKEN or POWERBOT_CHAT_ID not set, skipping Telegram posts")
-	}
-
-	for _, day := range parsed {
-		prev := findDay(st, day.Date)
-		if prev == nil {
-			logf("new schedule for %s, posting...", day.Date)
-			if token != "" && chatID != "" {
-				if err := postSchedule(token, chatID, day, false, false); err != nil {
-					logf("post error: %v", err)
-				} else {
-					logf("posted successfully")
-				}
-			}
-			st = upsertDay(st, day)
+	base := newTransport()
+	for _, p := range []struct {
+		env    string
+		client *http.Client
+	}{{proxyEnv, telegramClient}, {fetchProxyEnv, httpClient}} {
+		p.client.Transport = base.Clone()
+		v := os.Getenv(p.env)
+		if v == "" {
 			continue
 		}
-
-		changed, more := compareDay(*prev, day)
-		if changed {
-			logf("schedule changed for %s (more=%v), posting update...", day.Date, more)
-			if token != "" && chatID != "" {
-				if err := postSchedule(token, chatID, day, true, more); err != nil {
-					logf("post error: %v", err)
-				} else {
-					logf("update posted successfully")
-				}
-			}
-			st = upsertDay(st, day)
-		} else {
-			logf("schedule for %s unchanged, skipping", day.Date)
+		t, err := proxyTransport(base, v)
+		if err != nil {
+			logf("invalid %s: %v", p.env, err)
+			os.Exit(1)
 		}
+		p.client.Transport = t
 	}
-
-	st = keepLastTwo(st, datesToCheck)
-	if err := saveState(statePath, st); err != nil {
-		logf("state save error: %v", err)
+	if v := os.Getenv(fetchURLEnv); v != "" {
+		if u, err := url.Parse(v); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			logf("invalid %s %q: want an http(s) URL", fetchURLEnv, v)
+			os.Exit(1)
+		}
+		fetchURL = v
+		logf("fetching schedules from %s (%s)", fetchURL, fetchURLEnv)
+	} else if os.Getenv(debugEnv) != "" {
+		logf("debug: fetching schedules from the default %s", fetchURL)
 	}
-}
-
-func loadContent() (string, error) {
-	debug := os.Getenv(debugEnv) != ""
-	if path := os.Getenv(testFileEnv); path != "" {
-		b, err := os.ReadFile(path)
-		if debug {
-			logf("debug: reading from test file: %s", path)
+	if v := os.Getenv(externalURLEnv); v != "" {
+		u, err := checkExternalURL(v)
+		if err != nil {
+			logf("invalid %s %q: %v", externalURLEnv, v, err)
+			os.Exit(1)
 		}
-		return string(b), err
+		externalURL = u
 	}
-	if debug {
-		logf("debug: fetching from URL: %s", fetchURL)
+	maxIntervals = loadMaxIntervals()
+	dryRun = *dryRunFlag || os.Getenv(dryRunEnv) != ""
+	dryRunNoSave = dryRun && (*noSaveFlag || os.Getenv(dryRunNoSaveEnv) != "")
+	if dryRun {
+		logf("dry-run: posts are printed to stdout, nothing is sent")
+		if dryRunNoSave {
+			logf("dry-run: state file will not be written")
+		}
 	}
-	resp, err := http.Get(fetchURL)
-	if err != nil {
-		return "", err
+
+	if v := os.Getenv(groupsEnv); strings.EqualFold(v, "auto") {
+		autoGroups = true
+	} else if v != "" {
+		watched = loadGroups(v)
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("status %d", resp.StatusCode)
+	if v := os.Getenv(groupAliasesEnv); v != "" {
+		watched = applyAliases(watched, v)
 	}
-	b, err := io.ReadAll(resp.Body)
+	tmpl, err := loadMessageTemplate()
 	if err != nil {
-		return "", err
+		logf("message template: %v", err)
+		os.Exit(1)
 	}
-	if debug {
-		logf("debug: received %d bytes from API", len(b))
-	}
-
-	// Parse JSON response
-	var apiResponse struct {
-		HydraMember []struct {
-			MenuItems []struct {
-				Name    string `json:"name"`
-				RawHtml string `json:"rawHtml"`
-			} `json:"menuItems"`
-		} `json:"hydra:member"`
-	}
-	if err := json.Unmarshal(b, &apiResponse); err != nil {
-		if debug {
-			logf("debug: JSON unmarshal error: %v", err)
-			logf("debug: response preview (first 500 chars): %s", string(b[:min(500, len(b))]))
+	messageTmpl = tmpl
+	for _, name := range []string{chatIDEnv, debugChatEnv, adminChatEnv, errorChatEnv} {
+		v := os.Getenv(name)
+		if v == "" {
+			continue
 		}
-		return "", fmt.Errorf("failed to parse API response: %w", err)
-	}
-
-	// Extract rawHtml from menuItems
-	for _, member := range apiResponse.HydraMember {
-		for _, item := range member.MenuItems {
-			if item.RawHtml != "" {
-				if debug {
-					logf("debug: extracted rawHtml from menu item '%s' (%d bytes)", item.Name, len(item.RawHtml))
-				}
-				return item.RawHtml, nil
+		// Only POWERBOT_CHAT_ID takes a comma-separated list.
+		parts := []string{v}
+		if name == chatIDEnv {
+			parts = strings.Split(v, ",")
+		}
+		var ids []string
+		for _, part := range parts {
+			if len(parts) > 1 && strings.TrimSpace(part) == "" {
+				continue
 			}
+			id, err := normalizeChatID(part)
+			if err != nil {
+				logf("invalid %s: %v", name, err)
+				os.Exit(1)
+			}
+			ids = append(ids, id)
 		}
+		os.Setenv(name, strings.Join(ids, ","))
 	}
-
-	return "", fmt.Errorf("no rawHtml found in API response")
-}
-
-func min(a, b int) int {
-	if a < b {
-		return a
+	ctx := context.Background()
+	if os.Getenv(botEnv) != "" {
+		ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		if err := runBot(ctx); err != nil && ctx.Err() == nil {
+			logf("bot: %v", err)
+			os.Exit(1)
+		}
+		return
 	}
-	return b
-}
-
-// parsePage uses regex-based extraction; assumes stable, simple HTML/text.
-func parsePage(body string, dates []time.Time) ([]DayInfo, error) {
-	var out []DayInfo
-	debug := os.Getenv(debugEnv) != ""
-	if debug {
-		// Save first 2000 chars for inspection
-		preview := body
-		if len(preview) > 2000 {
-			preview = preview[:2000]
+	if *correctDate != "" {
+		if err := runCorrection(ctx, *correctDate); err != nil {
+			logf("correct: %v", err)
+			os.Exit(1)
 		}
-		logf("debug: HTML preview (first 2000 chars):\n%s", preview)
-		// Check if we can find the date pattern at all
-		datePat := regexp.MustCompile(`Графік погодинних відключень на\s+\d{2}\.\d{2}\.\d{4}`)
-		matches := datePat.FindAllString(body, -1)
-		logf("debug: found %d date headers: %v", len(matches), matches)
+		return
 	}
-	for _, d := range dates {
-		dateTitle := d.Format("02.01.2006")
-		if debug {
-			logf("debug: looking for date '%s'", dateTitle)
+	if *importPath != "" {
+		if err := importState(*importPath); err != nil {
+			logf("import-state: %v", err)
+			os.Exit(1)
 		}
-		section := extractSection(body, dateTitle)
-		if section == "" {
-			if debug {
-				logf("debug: no section found for %s", dateTitle)
-			}
-			continue
+		return
+	}
+	if *simulatePath != "" {
+		if err := simulate(ctx, *simulatePath, os.Stdout); err != nil {
+			logf("simulate: %v", err)
+			os.Exit(1)
 		}
-		if debug {
-			preview := section
-			if len(preview) > 500 {
-				preview = preview[:500]
-			}
-			logf("debug: found section for %s (first 500 chars):\n%s", dateTitle, preview)
+		return
+	}
+	if v := os.Getenv(daemonIntervalEnv); v != "" {
+		interval, err := time.ParseDuration(v)
+		if err != nil || interval <= 0 {
+			logf("invalid %s %q", daemonIntervalEnv, v)
+			os.Exit(1)
 		}
-		groups := map[string]GroupInfo{}
-		for _, g := range []string{groupPower, groupWater} {
-			txt := extractGroup(section, g)
-			if debug {
-				if txt == "" {
-					logf("debug: group %s not found in section", g)
-				} else {
-					logf("debug: found group %s: '%s'", g, txt)
-				}
-			}
-			if txt == "" {
-				continue
+		if path := os.Getenv(pidFileEnv); path != "" {
+			release, err := acquirePIDFile(path)
+			if err != nil {
+				logf("daemon: %v", err)
+				os.Exit(1)
 			}
-			norm := normalizeText(txt)
-			mins := outageMinutes(norm)
-			groups[g] = GroupInfo{Text: norm, Minutes: mins}
+			defer release()
 		}
-		if len(groups) > 0 {
-			out = append(out, DayInfo{Date: d.Format("2006-01-02"), Groups: groups})
+		ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		if addr := os.Getenv(metricsAddrEnv); addr != "" {
+			if err := serveMetrics(ctx, addr); err != nil {
+				logf("metrics: %v", err)
+				os.Exit(1)
+			}
 		}
+		runDaemon(ctx, interval)
+		return
+	}
+	if os.Getenv(metricsAddrEnv) != "" {
+		logf("warning: %s needs %s, ignoring it (use %s for one-shot runs)", metricsAddrEnv, daemonIntervalEnv, pushgatewayEnv)
 	}
-	return out, nil
+	runCycle(ctx)
 }
 
-// extractSection grabs text between the date title and the next date title or end.
-func extractSection(body, dateTitle string) string {
-	// Try with HTML tags first (e.g., <b>Графік погодинних відключень на 12.12.2025</b>)
-	pat := regexp.MustCompile(`(?s)<b>Графік погодинних відключень на\s+` + regexp.QuoteMeta(dateTitle) + `</b>(.*?)(?:<b>Графік погодинних відключень на\s+\d{2}\.\d{2}\.\d{4}</b>|$)`)
-	m := pat.FindStringSubmatch(body)
-	if len(m) >= 2 {
-		return m[1]
+// serveMetrics serves the counters on addr at /metrics until ctx is
+// cancelled. Only the daemon stays up long enough to be scraped.
+func serveMetrics(ctx context.Context, addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
 	}
-	// Fallback: try without HTML tags
-	pat2 := regexp.MustCompile(`(?s)Графік погодинних відключень на\s+` + regexp.QuoteMeta(dateTitle) + `(.*?)(?:Графік погодинних відключень на\s+\d{2}\.\d{2}\.\d{4}|$)`)
-	m2 := pat2.FindStringSubmatch(body)
-	if len(m2) >= 2 {
-		return m2[1]
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		io.WriteString(w, metrics.exposition())
+	})
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: pingTimeout}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logf("metrics: %v", err)
+		}
+	}()
+	if externalURL != "" {
+		logf("metrics: serving http://%s/metrics, reachable as %s/metrics", ln.Addr(), externalURL)
+	} else {
+		logf("metrics: serving http://%s/metrics", ln.Addr())
 	}
-	return ""
+	return nil
 }
 
-// extractGroup finds the first text after the group label up to a period.
-func extractGroup(section, group string) string {
-	pat := regexp.MustCompile(regexp.QuoteMeta(group) + `[^\.]*\.?\s*([^\.]*\.)`)
-	m := pat.FindStringSubmatch(section)
-	if len(m) >= 2 {
-		return strings.TrimSpace(m[1])
+// checkExternalURL validates POWERBOT_EXTERNAL_URL: an absolute https URL,
+// optionally with the path prefix the proxy serves the bot under, but no
+// credentials, query or fragment. It is returned without a trailing slash,
+// ready to append paths to.
+func checkExternalURL(v string) (string, error) {
+	u, err := url.Parse(v)
+	switch {
+	case err != nil:
+		return "", err
+	case u.Scheme != "https" || u.Host == "":
+		return "", errors.New("want an absolute https URL")
+	case u.User != nil:
+		return "", errors.New("credentials don't belong in it")
+	case u.RawQuery != "" || u.ForceQuery || strings.Contains(v, "#"):
+		return "", errors.New("want no query or fragment")
 	}
-	// fallback: grab the sentence after the label
-	pat2 := regexp.MustCompile(regexp.QuoteMeta(group) + `.*?\.\s*([^.]+\.)`)
-	m2 := pat2.FindStringSubmatch(section)
-	if len(m2) >= 2 {
-		return strings.TrimSpace(m2[1])
+	if p := strings.TrimRight(u.Path, "/"); p != "" && path.Clean(p) != p {
+		return "", fmt.Errorf("path %q is not clean", u.Path)
 	}
-	return ""
+	return strings.TrimRight(u.String(), "/"), nil
 }
 
-func normalizeText(s string) string {
-	s = strings.TrimSpace(s)
-	s = strings.TrimPrefix(s, "—")
-	s = strings.TrimSpace(s)
-	s = strings.ReplaceAll(s, "\u00a0", " ")
-	s = strings.ReplaceAll(s, "  ", " ")
-	if strings.Contains(s, "Електроенергія є") {
-		return "буде!!!!"
+// runCorrection re-parses date from the current page and posts it under a
+// "виправлення" title, for when an earlier post was parsed wrong and users
+// need to know the schedule they saw is replaced.
+func runCorrection(ctx context.Context, date string) error {
+	d, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		if d, err = time.Parse("02.01.2006", date); err != nil {
+			return fmt.Errorf("bad date %q, want YYYY-MM-DD", date)
+		}
 	}
-	s = strings.TrimSuffix(s, ".")
-	return s
+	statePath := os.Getenv(statePathEnv)
+	if statePath == "" {
+		statePath = defaultState
+	}
+	st, stateErr := loadState(statePath)
+	if errors.Is(stateErr, errStateVersion) {
+		return stateErr
+	}
+	body, _, err := loadContent(ctx, State{})
+	if err != nil {
+		return fmt.Errorf("fetch: %w", err)
+	}
+	days, _, _ := parsePage(body, []time.Time{d})
+	if len(days) == 0 {
+		return fmt.Errorf("no schedule for %s on the page", d.Format("02.01.2006"))
+	}
+	day := days[0]
+	notifiers := append(loadNotifiers(), subscriberNotifiers(st)...)
+	if dryRun {
+		notifiers = []Notifier{printNotifier{w: os.Stdout, kind: "correction"}}
+	}
+	var errs []error
+	for _, n := range notifiers {
+		groups := watched
+		if f, ok := n.(groupFilter); ok && f.onlyGroups() != nil {
+			groups = f.onlyGroups()
+		}
+		if err := n.Notify(ctx, day, correctionText(day, groups)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("post: %w", err)
+	}
+	logf("correction for %s posted", day.Date)
+	st = markPosted(upsertDay(st, day), day)
+	if dryRunNoSave {
+		return nil
+	}
+	if errors.Is(stateErr, errStateCorrupt) {
+		logf("warning: state is corrupt, not saving the correction; the next run rebuilds it")
+		return nil
+	}
+	return saveStateLocked(statePath, st)
 }
 
-func outageMinutes(text string) int {
-	// expect "немає з HH:MM до HH:MM"
-	re := regexp.MustCompile(`з\s+(\d{2}):(\d{2})\s+до\s+(\d{2}):(\d{2})`)
-	m := re.FindStringSubmatch(text)
-	if len(m) != 5 {
-		return 0
+// correctionText is the regular post for day with a correction title.
+func correctionText(day DayInfo, groups []groupSpec) string {
+	msg := formatSchedule(day, false, 0, nil, groups)
+	dm := escapeMarkdownV2(schedule.ToDM(day.Date))
+	title := fmt.Sprintf("*графік на %s*", dm)
+	if strings.HasPrefix(msg, title) {
+		return fmt.Sprintf("*✏️ виправлення графіка на %s*", dm) + strings.TrimPrefix(msg, title)
 	}
-	h1, _ := time.Parse("15:04", m[1]+":"+m[2])
-	h2, _ := time.Parse("15:04", m[3]+":"+m[4])
-	return int(h2.Sub(h1).Minutes())
+	return "✏️ " + msg
 }
 
-func loadState(path string) (State, error) {
-	b, err := os.ReadFile(path)
-	if err != nil {
-		return State{}, err
+// acquirePIDFile writes our pid to path, refusing if it names another live
+// process. A stale file left by a crash is taken over. The returned func
+// removes the file again.
+func acquirePIDFile(path string) (func(), error) {
+	if b, err := os.ReadFile(path); err == nil {
+		pid, _ := strconv.Atoi(strings.TrimSpace(string(b)))
+		if pid > 0 && pid != os.Getpid() && processAlive(pid) {
+			return nil, fmt.Errorf("already running as pid %d (%s)", pid, path)
+		}
+		logf("daemon: taking over stale pid file %s", path)
 	}
-	var s State
-	err = json.Unmarshal(b, &s)
-	return s, err
+	if err := writeFileAtomic(path, []byte(strconv.Itoa(os.Getpid())+"\n")); err != nil {
+		return nil, fmt.Errorf("write pid file: %w", err)
+	}
+	return func() { os.Remove(path) }, nil
 }
 
-func saveState(path string, st State) error {
-	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
-		return err
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// runDaemon repeats runCycle every interval until ctx is cancelled.
+func runDaemon(ctx context.Context, interval time.Duration) {
+	logf("daemon: running every %s", interval)
+	if v := os.Getenv(startupDelayEnv); v != "" {
+		if delay, err := time.ParseDuration(v); err != nil || delay < 0 {
+			logf("warning: invalid %s %q, starting now", startupDelayEnv, v)
+		} else if delay > 0 {
+			logf("daemon: waiting %s before the first check", delay)
+			sleepCtx(ctx, delay)
+		}
 	}
-	tmp := path + ".tmp"
-	b, _ := json.MarshalIndent(st, "", "  ")
-	if err := os.WriteFile(tmp, b, 0o644); err != nil {
-		return err
+	for ctx.Err() == nil {
+		runCycle(ctx)
+		sleepCtx(ctx, interval)
 	}
-	return os.Rename(tmp, path)
+	logf("daemon: shutting down")
 }
 
-func findDay(st State, date string) *DayInfo {
-	for i := range st.Days {
-		if st.Days[i].Date == date {
-			return &st.Days[i]
+// runCycle does one run under POWERBOT_MAX_RUN_DURATION and reports the
+// outcome to the healthcheck and Pushgateway.
+func runCycle(ctx context.Context) {
+	if v := os.Getenv(maxRunEnv); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			logf("warning: invalid %s %q: %v", maxRunEnv, v, err)
+		} else {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, d)
+			defer cancel()
 		}
 	}
-	return nil
+	parseErrs := metrics.parseErrors.Load()
+	err := run(ctx)
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		logf("run deadline exceeded")
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+	if err == nil {
+		metrics.lastSuccess.Store(time.Now().Unix())
+	}
+	pingHealthcheck(err)
+	if path := os.Getenv(lastErrorFileEnv); path != "" {
+		writeLastError(path, err, time.Now())
+	}
+	if os.Getenv(errorChatEnv) != "" {
+		alertErr := err
+		if n := metrics.parseErrors.Load() - parseErrs; alertErr == nil && n > 0 {
+			alertErr = fmt.Errorf("parse: %d date(s) failed to parse", n)
+		}
+		if alertErr != nil {
+			reportError(alertErr, time.Now())
+		}
+	}
+	if gw := os.Getenv(pushgatewayEnv); gw != "" {
+		pushMetrics(gw)
+	}
 }
 
-func upsertDay(st State, day DayInfo) State {
-	found := false
-	for i := range st.Days {
-		if st.Days[i].Date == day.Date {
-			st.Days[i] = day
-			found = true
-			break
+// writeLastError records a failed run's error with a timestamp in path, or
+// removes path after a successful run.
+func writeLastError(path string, runErr error, now time.Time) {
+	if runErr == nil {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			logKV("warn", "last error file", "err", err)
 		}
+		return
 	}
-	if !found {
-		st.Days = append(st.Days, day)
+	line := now.Format(time.RFC3339) + " " + runErr.Error() + "\n"
+	if err := writeFileAtomic(path, []byte(line)); err != nil {
+		logKV("warn", "last error file", "err", err)
 	}
-	return st
 }
 
-func keepLastTwo(st State, refs []time.Time) State {
-	cutoff := map[string]bool{}
-	for _, d := range refs {
-		cutoff[d.Format("2006-01-02")] = true
-		cutoff[d.AddDate(0, 0, -1).Format("2006-01-02")] = true
+// reportError sends a failed run's error, with secrets redacted, to
+// POWERBOT_ERROR_CHAT. At most one goes out per POWERBOT_ERROR_INTERVAL; the
+// time of the last one is kept next to the state file so timer runs share the
+// limit.
+func reportError(runErr error, now time.Time) {
+	chatID := os.Getenv(errorChatEnv)
+	t, ok := newTelegramNotifier(chatID)
+	if !ok {
+		logf("warning: %s set but no bot token to send with", errorChatEnv)
+		return
 	}
-	var kept []DayInfo
-	for _, d := range st.Days {
-		if cutoff[d.Date] {
-			kept = append(kept, d)
+	interval := defaultErrorInterval
+	if v := os.Getenv(errorIntervalEnv); v != "" {
+		if d, err := time.ParseDuration(v); err != nil || d < 0 {
+			logf("warning: invalid %s %q, using %s", errorIntervalEnv, v, defaultErrorInterval)
+		} else {
+			interval = d
 		}
 	}
-	st.Days = kept
-	return st
+	statePath := os.Getenv(statePathEnv)
+	if statePath == "" {
+		statePath = defaultState
+	}
+	stamp := statePath + ".error-alert"
+	if b, err := os.ReadFile(stamp); err == nil {
+		if last, err := time.Parse(time.RFC3339, strings.TrimSpace(string(b))); err == nil && now.Sub(last) < interval {
+			logKV("info", "error alert suppressed", "last_sent", last.Format(time.RFC3339))
+			return
+		}
+	}
+	text := redact(runErr.Error())
+	if r := []rune(text); len(r) > 500 {
+		text = string(r[:500]) + "…"
+	}
+	msg := "⚠️ powerbot error:\n`" + strings.NewReplacer("\\", "\\\\", "`", "'").Replace(text) + "`"
+	if dryRun {
+		logf("dry-run: error alert would read:\n%s", msg)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+	// A plain message even with POWERBOT_IMAGE or threading on: Notify would
+	// render an empty day's picture with the error as its caption.
+	if err := sendTelegram(ctx, t.token, t.chatID, t.thread, msg); err != nil {
+		logKV("error", "error chat post failed", "err", redact(err.Error()))
+		return
+	}
+	if err := writeFileAtomic(stamp, []byte(now.Format(time.RFC3339)+"\n")); err != nil {
+		logf("warning: error alert stamp: %v", err)
+	}
 }
 
-func compareDay(old, cur DayInfo) (changed bool, more bool) {
-	for _, g := range []string{groupPower, groupWater} {
-		o, okO := old.Groups[g]
-		n, okN := cur.Groups[g]
-		if !okN && !okO {
-			continue
-		}
-		if !okO || !okN || o.Text != n.Text {
-			if n.Minutes > o.Minutes {
-				more = true
-			}
-			changed = true
+// redact blanks the bot tokens, GitHub token and SMTP password in s; HTTP
+// client errors quote the request URL, which carries the Telegram token.
+func redact(s string) string {
+	secrets := []string{os.Getenv(tokenEnv), os.Getenv(githubTokenEnv), os.Getenv(smtpPassEnv)}
+	for _, r := range chatRoutes() {
+		secrets = append(secrets, r.token)
+	}
+	for _, v := range secrets {
+		if len(v) >= 4 {
+			s = strings.ReplaceAll(s, v, "***")
 		}
 	}
-	return
+	return s
 }
 
-func postSchedule(token, chatID string, day DayInfo, isUpdate, more bool) error {
-	title := fmt.Sprintf("графік на %s", toDM(day.Date))
-	if isUpdate {
-		if more {
-			title = fmt.Sprintf("upd. 😩 на %s", toDM(day.Date))
+// newTransport returns the transport both shared clients start from, with
+// idle connections kept long enough (POWERBOT_IDLE_CONN_TIMEOUT) for daemon
+// cycles to reuse them.
+func newTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConnsPerHost = defaultMaxIdlePerHost
+	t.IdleConnTimeout = defaultIdleConnTimeout
+	if v := os.Getenv(maxIdlePerHostEnv); v != "" {
+		if n, err := strconv.Atoi(v); err != nil || n < 0 {
+			logf("warning: invalid %s %q, using %d", maxIdlePerHostEnv, v, defaultMaxIdlePerHost)
 		} else {
-			title = fmt.Sprintf("upd. 🍾 на %s", toDM(day.Date))
+			t.MaxIdleConnsPerHost = n
 		}
 	}
-	var lines []string
-	lines = append(lines, fmt.Sprintf("*%s*", title))
-	lines = append(lines, formatLine(day, groupPower, labelPower))
-	lines = append(lines, formatLine(day, groupWater, labelWater))
-	msg := strings.Join(lines, "\n")
-	return sendTelegram(token, chatID, msg)
-}
-
-func formatLine(day DayInfo, group, label string) string {
-	if g, ok := day.Groups[group]; ok {
-		return fmt.Sprintf("%s: %s", label, g.Text)
+	if v := os.Getenv(idleConnTimeoutEnv); v != "" {
+		if d, err := time.ParseDuration(v); err != nil || d < 0 {
+			logf("warning: invalid %s %q, using %s", idleConnTimeoutEnv, v, defaultIdleConnTimeout)
+		} else {
+			t.IdleConnTimeout = d
+		}
 	}
-	return fmt.Sprintf("%s: н/д", label)
+	if t.MaxIdleConnsPerHost == 0 {
+		t.DisableKeepAlives = true
+	}
+	return t
 }
 
-func toDM(date string) string {
-	t, _ := time.Parse("2006-01-02", date)
-	return t.Format("02.01")
+// drainClose reads what is left of a response body before closing it, so the
+// connection goes back to the idle pool instead of being dropped.
+func drainClose(body io.ReadCloser) {
+	io.Copy(io.Discard, io.LimitReader(body, 64<<10))
+	body.Close()
 }
 
-func sendTelegram(token, chatID, text string) error {
-	form := fmt.Sprintf("chat_id=%s&text=%s&parse_mode=Markdown", chatID, urlEncode(text))
-	resp, err := http.Post("https://api.telegram.org/bot"+token+"/sendMessage", "application/x-www-form-urlencoded", strings.NewReader(form))
+// proxyTransport returns a copy of base that goes through the proxy at raw,
+// an http://, https:// or socks5:// URL (net/http speaks SOCKS5 itself).
+func proxyTransport(base *http.Transport, raw string) (*http.Transport, error) {
+	u, err := url.Parse(raw)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
-		return fmt.Errorf("telegram status %d: %s", resp.StatusCode, string(body))
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q in %q, want http, https or socks5", u.Scheme, raw)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("no proxy host in %q", raw)
+	}
+	t := base.Clone()
+	t.Proxy = http.ProxyURL(u)
+	return t, nil
+}
+
+// runMetrics are the counters exported to Prometheus.
+type runMetrics struct {
+	fetchErrors atomic.Int64
+	parseErrors atomic.Int64
+	postsNew    atomic.Int64
+	postsUpdate atomic.Int64
+	postErrors  atomic.Int64
+	lastSuccess atomic.Int64 // unix seconds, 0 until a run succeeds
+}
+
+var metrics runMetrics
+
+// exposition renders m in the Prometheus text format.
+func (m *runMetrics) exposition() string {
+	var b strings.Builder
+	b.WriteString("# TYPE powerbot_fetch_errors_total counter\n")
+	fmt.Fprintf(&b, "powerbot_fetch_errors_total %d\n", m.fetchErrors.Load())
+	b.WriteString("# TYPE powerbot_parse_errors_total counter\n")
+	fmt.Fprintf(&b, "powerbot_parse_errors_total %d\n", m.parseErrors.Load())
+	b.WriteString("# TYPE powerbot_posts_total counter\n")
+	fmt.Fprintf(&b, "powerbot_posts_total{type=\"new\"} %d\n", m.postsNew.Load())
+	fmt.Fprintf(&b, "powerbot_posts_total{type=\"update\"} %d\n", m.postsUpdate.Load())
+	b.WriteString("# TYPE powerbot_post_errors_total counter\n")
+	fmt.Fprintf(&b, "powerbot_post_errors_total %d\n", m.postErrors.Load())
+	if ts := m.lastSuccess.Load(); ts > 0 {
+		b.WriteString("# TYPE powerbot_last_success_timestamp gauge\n")
+		fmt.Fprintf(&b, "powerbot_last_success_timestamp %d\n", ts)
+	}
+	return b.String()
+}
+
+// pushMetrics sends this run's metrics to a Prometheus Pushgateway under job
+// "powerbot". POST keeps the previously pushed last-success timestamp when
+// this run failed. Best-effort only.
+func pushMetrics(gateway string) {
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+	u := strings.TrimSuffix(gateway, "/") + "/metrics/job/powerbot"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, strings.NewReader(metrics.exposition()))
+	if err != nil {
+		logKV("error", "pushgateway push failed", "err", err)
+		return
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		logKV("error", "pushgateway push failed", "err", err)
+		return
+	}
+	drainClose(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		logf("pushgateway status %d", resp.StatusCode)
+	}
+}
+
+// pingHealthcheck reports the run outcome to POWERBOT_PING_URL, appending
+// "/fail" on failure (the healthchecks.io convention). Best-effort only.
+func pingHealthcheck(runErr error) {
+	pingURL := os.Getenv(pingURLEnv)
+	if pingURL == "" {
+		return
+	}
+	body := "ok"
+	if runErr != nil {
+		pingURL = strings.TrimSuffix(pingURL, "/") + "/fail"
+		body = runErr.Error()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, pingURL, strings.NewReader(body))
+	if err != nil {
+		logKV("error", "healthcheck ping failed", "err", err)
+		return
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		logKV("error", "healthcheck ping failed", "err", err)
+		return
+	}
+	drainClose(resp.Body)
+	if resp.StatusCode != 200 {
+		logf("ping status %d", resp.StatusCode)
+	}
+}
+
+// loadGroups parses a comma-separated list of group keys, e.g. "power" for a
+// deployment without a water schedule. Unknown keys are skipped.
+func loadGroups(v string) []groupSpec {
+	var out []groupSpec
+	for _, key := range strings.Split(v, ",") {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+		g, ok := knownGroups[strings.ToLower(key)]
+		if !ok {
+			// Anything else must be a group number: "3.2" or "Група 3.2".
+			num := groupNumber(strings.Join(strings.Fields(key), " "))
+			if !groupNumberRe.MatchString(num) {
+				logf("warning: unknown group %q in %s, ignoring", key, groupsEnv)
+				continue
+			}
+			g = groupByName("Група " + num)
+		}
+		dup := false
+		for _, o := range out {
+			dup = dup || o.Name == g.Name
+		}
+		if !dup {
+			out = append(out, g)
+		}
+	}
+	if len(out) == 0 {
+		logf("warning: no valid groups in %s, using defaults", groupsEnv)
+		return watched
+	}
+	return out
+}
+
+// detectGroups builds the group list from the labels in today's section (or
+// the whole page if today has none). Known groups keep their usual labels.
+func detectGroups(body string, today time.Time) []groupSpec {
+	labels := schedule.GroupLabels(newParser().ExtractSection(body, today.Format("02.01.2006")))
+	if len(labels) == 0 {
+		labels = schedule.GroupLabels(body)
+	}
+	var out []groupSpec
+	for _, name := range labels {
+		out = append(out, groupByName(strings.Join(strings.Fields(name), " ")))
+	}
+	return out
+}
+
+// applyAliases replaces posted labels with local names from a list like
+// "6.1=вул. Шевченка;4.1=ЖК Сонячний". Keys may be the group key ("power"),
+// its number ("6.1") or the official name ("Група 6.1"); matching against
+// the page still uses the official name.
+func applyAliases(groups []groupSpec, v string) []groupSpec {
+	aliases := map[string]string{}
+	for _, pair := range strings.Split(v, ";") {
+		k, alias, ok := strings.Cut(pair, "=")
+		k, alias = strings.TrimSpace(k), strings.TrimSpace(alias)
+		if !ok || k == "" || alias == "" {
+			if strings.TrimSpace(pair) != "" {
+				logf("warning: bad entry %q in %s, ignoring", pair, groupAliasesEnv)
+			}
+			continue
+		}
+		aliases[k] = alias
+	}
+	out := make([]groupSpec, len(groups))
+	for i, g := range groups {
+		out[i] = g
+		keys := []string{g.Name, strings.TrimSpace(strings.TrimPrefix(g.Name, "Група"))}
+		for key, known := range knownGroups {
+			if known.Name == g.Name {
+				keys = append(keys, key)
+			}
+		}
+		for _, k := range keys {
+			if alias, ok := aliases[k]; ok {
+				out[i].Label = fmt.Sprintf("*%s %s*", g.Emoji, escapeMarkdownV2(alias))
+				break
+			}
+		}
+	}
+	return out
+}
+
+// run performs one fetch/parse/post cycle. Every network call honours ctx so
+// the whole cycle stays inside POWERBOT_MAX_RUN_DURATION.
+func run(ctx context.Context) error {
+	debug := os.Getenv(debugEnv) != ""
+
+	statePath := os.Getenv(statePathEnv)
+	if statePath == "" {
+		statePath = defaultState
+	}
+	st, err := loadState(statePath)
+	if fb := os.Getenv(stateFallbackEnv); fb != "" && newerFile(fb, statePath) {
+		logf("fallback state %s is newer than %s, using it", fb, statePath)
+		st, err = loadState(fb)
+	}
+	if errors.Is(err, errStateVersion) {
+		logf("error: %v, refusing to run", err)
+		return err
+	}
+	if debug && err != nil {
+		logf("debug: loadState error (non-fatal): %v", err)
+	}
+	fresh := errors.Is(err, fs.ErrNotExist)
+	corrupt := errors.Is(err, errStateCorrupt)
+
+	// A 304 only says the page is as it was. Once the window has moved on,
+	// days on it that were out of range then may be due now, so the page is
+	// fetched and processed in full again.
+	window := windowKey(checkDates(startOfDay(time.Now())))
+	if st.PagesFor != window {
+		st.Pages = nil
+	}
+
+	// Neither an unchanged page nor a failed fetch ends the run: the
+	// clock-driven work further down is due either way.
+	htmlBody, cache, err := loadContent(ctx, st)
+	gotPage := err == nil
+	var fetchErr error
+	switch {
+	case errors.Is(err, errNotModified):
+		logf("source not modified since last run, nothing new to post")
+	case err != nil:
+		logKV("error", "fetch failed", "err", err)
+		metrics.fetchErrors.Add(1)
+		fetchErr = fmt.Errorf("fetch: %w", err)
+	case debug:
+		logf("debug: fetched %d bytes", len(htmlBody))
+	}
+	if gotPage && os.Getenv(refetchEnv) != "" && headersWithoutSchedule(htmlBody, time.Now()) {
+		logf("warning: page has schedule headers but nothing parsed, re-fetching in %s", refetchDelay)
+		sleepCtx(ctx, refetchDelay)
+		if body, c, err := loadContent(ctx, st); err == nil {
+			htmlBody, cache = body, c
+		} else if !errors.Is(err, errNotModified) {
+			logKV("error", "re-fetch failed", "err", err)
+		}
+	}
+	if gotPage {
+		if prev, err := time.Parse(time.RFC3339, st.SourceUpdated); err == nil && !cache.Updated.IsZero() && cache.Updated.Before(prev) {
+			logf("warning: feed appears stale (updated %s, earlier than the %s seen before)", cache.Updated.Format(time.RFC3339), st.SourceUpdated)
+		}
+		if !cache.Updated.IsZero() || st.SourceUpdated == "" {
+			st.SourceUpdated = feedTime(cache.Updated)
+		}
+		if dir := os.Getenv(dumpHTMLEnv); dir != "" {
+			if err := dumpHTML(dir, htmlBody, time.Now()); err != nil {
+				logf("warning: dump html: %v", err)
+			}
+		}
+		if err := checkFresh(htmlBody, time.Now()); err != nil {
+			logf("warning: %v", err)
+			if os.Getenv(strictFreshEnv) != "" {
+				fetchErr, gotPage = fmt.Errorf("fetch: %w", err), false
+			}
+		}
+	}
+
+	notifiers := append(loadNotifiers(), subscriberNotifiers(st)...)
+	if os.Getenv(replyThreadEnv) != "" {
+		if st.Messages == nil {
+			st.Messages = map[string]int{}
+		}
+		notifiers = threadReplies(notifiers, st.Messages)
+	}
+	alerts := loadDebugNotifier()
+	if dryRun {
+		notifiers = []Notifier{printNotifier{w: os.Stdout, kind: "post"}}
+		alerts = printNotifier{w: os.Stdout, kind: "alert"}
+	} else if len(notifiers) == 0 {
+		logf("warning: POWERBOT_TOKEN/POWERBOT_CHAT_ID or POWERBOT_SMTP_HOST not set, skipping posts")
+	}
+	// A missing state file means a fresh deployment; record what is already
+	// published without announcing it.
+	if fresh && os.Getenv(silentFirstRunEnv) != "" {
+		logf("first run with no state, recording schedules without posting")
+		notifiers = nil
+	}
+	// Without the state every known schedule would look new; re-posting all
+	// of them is worse than missing one change, so only rebuild the state.
+	if corrupt {
+		logf("error: state was lost, recording schedules without posting this run")
+		notifiers = nil
+	}
+
+	checkpoint := func(st State) {
+		if err := saveStateLocked(statePath, st); err != nil {
+			logf("warning: checkpoint save failed: %v", err)
+		}
+	}
+	if dryRunNoSave {
+		checkpoint = nil
+	}
+	var parsed []DayInfo
+	var postErr error
+	posted := map[string]bool{}
+	if gotPage {
+		st, parsed, postErr = process(ctx, time.Now(), htmlBody, st, notifiers, alerts, checkpoint, posted)
+		if sock := os.Getenv(ipcSocketEnv); sock != "" {
+			publishIPC(sock, parsed)
+		}
+		// Only remember the validators once everything was posted, so a
+		// failed post is retried instead of being skipped as "not modified".
+		if postErr == nil {
+			st.Pages, st.PagesFor = cache.Pages, window
+		}
+	}
+
+	// From here on, every cycle, whatever the fetch brought.
+	now := time.Now()
+	st, err = periodic(ctx, st, now, posted, notifiers)
+	postErr = errors.Join(postErr, err)
+	admin := loadAdminNotifier()
+	if dryRun {
+		admin = printNotifier{w: os.Stdout, kind: "alert"}
+	}
+	// Without a new page, the days the last one parsed to stand in for this
+	// cycle's; they age out of the window if parsing has been broken since.
+	healthy := parsed
+	if !gotPage {
+		healthy = boardDays(st, now)
+	}
+	st = checkParseHealth(ctx, st, healthy, now, admin)
+	if os.Getenv(countdownPinEnv) != "" {
+		if dryRun {
+			logf("dry-run: countdown pin would read:\n%s", countdownText(st, time.Now()))
+		} else {
+			st = updatePin(ctx, st, time.Now())
+		}
+	}
+	runErr := errors.Join(fetchErr, postErr)
+	if dryRunNoSave {
+		return runErr
+	}
+	if corrupt {
+		// Only a processed page rebuilds what was lost; saving anything less
+		// would make the next run take every schedule for new.
+		if !gotPage {
+			logf("error: state is still corrupt, not saving until a page is processed")
+			return runErr
+		}
+		keepCorrupt(statePath)
+	}
+	if err := saveStateLocked(statePath, st); err != nil {
+		logKV("error", "state save failed", "err", err)
+		return errors.Join(runErr, fmt.Errorf("save state: %w", err))
+	}
+	return runErr
+}
+
+// publishIPC writes the parsed days as one JSON document to a local Unix
+// socket for desktop widgets. Nobody listening is normal, so errors are only
+// logged in debug mode.
+func publishIPC(path string, days []DayInfo) {
+	conn, err := net.DialTimeout("unix", path, ipcTimeout)
+	if err != nil {
+		if os.Getenv(debugEnv) != "" {
+			logf("debug: ipc socket %s unavailable: %v", path, err)
+		}
+		return
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(ipcTimeout))
+	if days == nil {
+		days = []DayInfo{}
+	}
+	if err := json.NewEncoder(conn).Encode(days); err != nil {
+		logKV("error", "ipc write failed", "err", err)
+	}
+}
+
+// breakerLimits returns the update circuit breaker settings; limit 0 means off.
+func breakerLimits() (limit int, window time.Duration) {
+	if v := os.Getenv(breakerMaxEnv); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			limit = n
+		} else {
+			logf("warning: invalid %s %q, breaker disabled", breakerMaxEnv, v)
+		}
+	}
+	window = defaultBreakerWindow
+	if v := os.Getenv(breakerWindowEnv); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			window = d
+		} else {
+			logf("warning: invalid %s %q, using %s", breakerWindowEnv, v, defaultBreakerWindow)
+		}
+	}
+	return limit, window
+}
+
+// checkBreaker records an update for key at now unless limit updates were
+// already posted within the window. While tripped, updates are held (state is
+// not advanced) and notice is true the first time, so the channel gets one
+// warning; the latest schedule goes out as an update once the window passes.
+func checkBreaker(st State, key string, now time.Time) (State, bool, bool) {
+	limit, window := breakerLimits()
+	if limit == 0 {
+		return st, true, false
+	}
+	if st.Updates == nil {
+		st.Updates = map[string]updateLog{}
+	}
+	log := st.Updates[key]
+	since := now.Add(-window).Unix()
+	var recent []int64
+	for _, t := range log.Times {
+		if t > since {
+			recent = append(recent, t)
+		}
+	}
+	log.Times = recent
+	if len(recent) >= limit {
+		notice := !log.Tripped
+		log.Tripped = true
+		st.Updates[key] = log
+		return st, false, notice
+	}
+	log.Tripped = false
+	log.Times = append(log.Times, now.Unix())
+	st.Updates[key] = log
+	return st, true, false
+}
+
+// kyivFallback stands in for Europe/Kyiv on systems without tzdata: winter
+// time all year, so summer times are an hour early, but nothing panics.
+var kyivFallback = time.FixedZone("EET", 2*3600)
+
+// kyivZone loads Europe/Kyiv once, falling back to kyivFallback; err says
+// why the real zone is missing.
+var kyivZone = sync.OnceValues(func() (*time.Location, error) {
+	loc, err := time.LoadLocation(kyivTZ)
+	if err != nil {
+		return kyivFallback, err
+	}
+	return loc, nil
+})
+
+// kyivLocation returns Europe/Kyiv, or kyivFallback when the zone can't be
+// loaded (main warns about that once at startup).
+func kyivLocation() *time.Location {
+	loc, _ := kyivZone()
+	return loc
+}
+
+// startOfDay returns Kyiv midnight of the calendar day containing now.
+// (Truncate would cut at UTC midnight, which is 02:00 or 03:00 in Kyiv.)
+func startOfDay(now time.Time) time.Time {
+	loc := kyivLocation()
+	y, m, d := now.In(loc).Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, loc)
+}
+
+// checkDates returns today plus POWERBOT_LOOKAHEAD_DAYS following days
+// (default 1, i.e. today and tomorrow).
+func checkDates(today time.Time) []time.Time {
+	ahead := defaultLookahead
+	if v := os.Getenv(lookaheadEnv); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			logf("warning: invalid %s %q, using %d", lookaheadEnv, v, defaultLookahead)
+		} else {
+			ahead = n
+		}
+	}
+	dates := make([]time.Time, 0, ahead+1)
+	for i := 0; i <= ahead; i++ {
+		dates = append(dates, today.AddDate(0, 0, i))
+	}
+	return dates
+}
+
+// windowKey names the window of dates as its first and last day, e.g.
+// "2025-12-12..2025-12-13".
+func windowKey(dates []time.Time) string {
+	return dates[0].Format("2006-01-02") + ".." + dates[len(dates)-1].Format("2006-01-02")
+}
+
+// feedTime formats the feed's update time for State.SourceUpdated, "" if
+// unknown.
+func feedTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// checkFresh flags a feed whose newest date header is before today, which
+// usually means a CDN is serving yesterday's cached copy.
+func checkFresh(body string, now time.Time) error {
+	latest, ok := schedule.LatestHeader(body)
+	if !ok {
+		return nil
+	}
+	if latest.Format("2006-01-02") < startOfDay(now).Format("2006-01-02") {
+		return fmt.Errorf("feed appears stale (latest header is %s)", latest.Format("02.01.2006"))
+	}
+	return nil
+}
+
+// headersWithoutSchedule reports whether body has date headers but none of the
+// days we look for parses, which usually means a partially published page.
+func headersWithoutSchedule(body string, now time.Time) bool {
+	if _, ok := schedule.LatestHeader(body); !ok {
+		return false
+	}
+	days, _, _ := parsePage(body, checkDates(startOfDay(now)))
+	return len(days) == 0
+}
+
+// process parses body as of now, posts new and changed days, and returns the
+// updated state and the parsed days along with any post errors. alerts
+// receives operator warnings and may be nil.
+// checkpoint, when non-nil, is called with the updated state after every
+// successful post so a crash later in the run cannot cause a re-post.
+func process(ctx context.Context, now time.Time, body string, st State, notifiers []Notifier, alerts Notifier, checkpoint func(State), posted map[string]bool) (State, []DayInfo, error) {
+	today := startOfDay(now)
+	datesToCheck := checkDates(today)
+	if autoGroups {
+		if groups := detectGroups(body, today); len(groups) > 0 {
+			watched = applyAliases(groups, os.Getenv(groupAliasesEnv))
+			logf("auto-detected %d groups", len(watched))
+		}
+	}
+
+	parsed, unrecognized, err := parsePage(body, datesToCheck)
+	if err != nil {
+		logKV("error", "parse failed", "err", err)
+		return st, nil, err
+	}
+	parsed = dropFarFuture(parsed, today)
+	for i := range parsed {
+		parsed[i].Updated = st.SourceUpdated
+	}
+	var looking []string
+	for _, d := range datesToCheck {
+		looking = append(looking, d.Format("02.01.2006"))
+	}
+	logf("parsed %d days (looking for %s)", len(parsed), strings.Join(looking, ", "))
+	if len(parsed) == 0 {
+		logf("warning: no schedules found for today through %s", looking[len(looking)-1])
+	} else {
+		for _, d := range parsed {
+			logf("found schedule for %s with %d groups", d.Date, len(d.Groups))
+			for k, v := range d.Groups {
+				logf("  %s => %s (mins=%d)", k, v.Text, v.Minutes)
+			}
+		}
+	}
+
+	for _, u := range unrecognized {
+		logf("warning: found schedule for %s but none of our groups (present: %v)", u.Date, u.Present)
+		st = warnUnrecognized(ctx, st, u, alerts)
+	}
+
+	var errs []error
+	var pending []pendingPost
+	_, hold := digestAt()
+	for _, day := range parsed {
+		if ctx.Err() != nil {
+			break
+		}
+		st = escalateCritical(ctx, st, day)
+		prev := findDay(st, day)
+		if prev == nil {
+			if alreadyPosted(st, day) {
+				logf("schedule for %s already posted, skipping", day.Date)
+				st = upsertDay(st, day)
+				continue
+			}
+			if hold {
+				logf("new schedule for %s, holding it for the digest", day.Date)
+				st = upsertDay(st, day)
+				continue
+			}
+			logf("new schedule for %s, posting...", day.Date)
+			pending = append(pending, pendingPost{day: day})
+			continue
+		}
+
+		changed, worse, cleared := compareDay(*prev, day)
+		if changed && hold && (worse <= 0 || os.Getenv(digestBreakthroughEnv) == "") {
+			logf("schedule changed for %s, holding it for the digest", day.Date)
+			st = upsertDay(st, day)
+			continue
+		}
+		if changed {
+			var allowed, notice bool
+			st, allowed, notice = checkBreaker(st, dayKey(day), now)
+			if !allowed {
+				logf("schedule for %s changes too often, holding updates", day.Date)
+				if notice && len(notifiers) > 0 {
+					msg := fmt.Sprintf("⚠️ графік на %s часто змінюється, перевірте джерело", escapeMarkdownV2(schedule.ToDM(day.Date)))
+					for _, n := range notifiers {
+						if err := n.Notify(ctx, day, msg); err != nil {
+							logKV("error", "post failed", "err", err)
+						}
+					}
+				}
+				continue
+			}
+			if alreadyPosted(st, day) {
+				logf("schedule for %s already posted, skipping", day.Date)
+				st = upsertDay(st, day)
+				continue
+			}
+			if worse < 0 {
+				logf("schedule changed for %s (new groups listed), posting update...", day.Date)
+			} else {
+				logf("schedule changed for %s (worse by %d min), posting update...", day.Date, worse)
+			}
+			pending = append(pending, pendingPost{day: day, update: true, worse: worse, cleared: cleared})
+		} else {
+			logf("schedule for %s unchanged, skipping", day.Date)
+			if !alreadyPosted(st, day) && !hold {
+				st = markPosted(st, day)
+			}
+		}
+	}
+
+	// Posts go out once every day was compared, so that with
+	// POWERBOT_COMBINE_DAYS identical days can share one.
+	for _, run := range postRuns(pending) {
+		if ctx.Err() != nil {
+			break
+		}
+		days := make([]DayInfo, len(run))
+		worse := run[0].worse
+		for i, p := range run {
+			days[i] = p.day
+			worse = max(worse, p.worse)
+		}
+		if len(run) > 1 {
+			logf("schedules for %s..%s are the same, posting them together", days[0].Date, days[len(days)-1].Date)
+		}
+		if len(notifiers) > 0 {
+			chats, err := postRun(ctx, unseen(st, notifiers, days...), days, run[0].update, worse, run[0].cleared)
+			for _, day := range days {
+				st = markPushed(st, day, chats)
+			}
+			if err != nil {
+				logKV("error", "post failed", "err", err)
+				errs = append(errs, err)
+				metrics.postErrors.Add(1)
+			} else {
+				if run[0].update {
+					logf("update posted successfully")
+					metrics.postsUpdate.Add(1)
+				} else {
+					logf("posted successfully")
+					metrics.postsNew.Add(1)
+				}
+				for _, day := range days {
+					st = markPosted(st, day)
+					posted[dayKey(day)] = true
+				}
+			}
+		}
+		for _, day := range days {
+			st = upsertDay(st, day)
+		}
+		if posted[dayKey(days[0])] && checkpoint != nil {
+			checkpoint(st)
+		}
+	}
+
+	if _, _, ok := weeklyAt(); ok {
+		st = recordTotals(st, parsed, today)
+	}
+
+	return st, parsed, errors.Join(errs...)
+}
+
+// pendingPost is a new (or, with update set, changed) day process is about
+// to post.
+type pendingPost struct {
+	day     DayInfo
+	update  bool
+	worse   int
+	cleared []string
+}
+
+// postRuns groups pending posts as dayRuns groups days: with
+// POWERBOT_COMBINE_DAYS, consecutive days with the same schedule that are
+// both new, or both updates without cleared groups, share one post.
+func postRuns(pending []pendingPost) [][]pendingPost {
+	combine := os.Getenv(combineDaysEnv) != ""
+	var runs [][]pendingPost
+	for _, p := range pending {
+		if n := len(runs); combine && n > 0 {
+			run := runs[n-1]
+			last := run[len(run)-1]
+			if last.update == p.update && len(last.cleared)+len(p.cleared) == 0 && len(combineDays([]DayInfo{last.day, p.day})) == 1 {
+				runs[n-1] = append(run, p)
+				continue
+			}
+		}
+		runs = append(runs, []pendingPost{p})
+	}
+	return runs
+}
+
+// periodic is the clock-driven upkeep every cycle does, whether or not the
+// page changed: it drops state outside the checked window and posts the
+// digest and weekly summary once they are due. posted holds the dates this
+// cycle already posted.
+func periodic(ctx context.Context, st State, now time.Time, posted map[string]bool, notifiers []Notifier) (State, error) {
+	st = keepWindow(st, checkDates(startOfDay(now)))
+	var errs []error
+	if at, _ := digestAt(); ctx.Err() == nil {
+		var err error
+		if st, err = postDigest(ctx, now, at, st, posted, notifiers); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if wd, at, ok := weeklyAt(); ok && ctx.Err() == nil {
+		var err error
+		if st, err = postWeekly(ctx, now, wd, at, st, notifiers); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return st, errors.Join(errs...)
+}
+
+// weeklyAt parses POWERBOT_WEEKLY_SUMMARY_AT, a weekday and Kyiv time such as
+// "sun 20:00" or "Sunday 20:00". ok is false when it is unset or invalid.
+func weeklyAt() (wd time.Weekday, at time.Duration, ok bool) {
+	v := os.Getenv(weeklySummaryEnv)
+	if v == "" {
+		return 0, 0, false
+	}
+	if name, hm, found := strings.Cut(strings.TrimSpace(v), " "); found {
+		t, err := time.Parse("15:04", strings.TrimSpace(hm))
+		for d := time.Sunday; err == nil && d <= time.Saturday; d++ {
+			if strings.EqualFold(name, d.String()) || strings.EqualFold(name, d.String()[:3]) {
+				return d, time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, true
+			}
+		}
+	}
+	logf("warning: invalid %s %q (want e.g. \"sun 20:00\"), weekly summary disabled", weeklySummaryEnv, v)
+	return 0, 0, false
+}
+
+// recordTotals stores each parsed day's outage minutes per group and drops
+// totals older than a week before today. Only the deployment's own region
+// (POWERBOT_REGION) counts towards the weekly summary.
+func recordTotals(st State, parsed []DayInfo, today time.Time) State {
+	if st.Totals == nil {
+		st.Totals = map[string]map[string]int{}
+	}
+	for _, day := range parsed {
+		if day.Region != os.Getenv(regionEnv) {
+			continue
+		}
+		mins := map[string]int{}
+		for name, g := range day.Groups {
+			mins[name] = g.Minutes
+		}
+		st.Totals[day.Date] = mins
+	}
+	cutoff := today.AddDate(0, 0, -7).Format("2006-01-02")
+	for date := range st.Totals {
+		if date < cutoff {
+			delete(st.Totals, date)
+		}
+	}
+	return st
+}
+
+// postWeekly posts the weekly summary once on weekday wd from the time of
+// day at on. It is never threaded under the day's schedule post.
+func postWeekly(ctx context.Context, now time.Time, wd time.Weekday, at time.Duration, st State, notifiers []Notifier) (State, error) {
+	if len(notifiers) == 0 {
+		return st, nil
+	}
+	loc := kyivLocation()
+	today := startOfDay(now)
+	local := now.In(loc)
+	sinceMidnight := time.Duration(local.Hour())*time.Hour + time.Duration(local.Minute())*time.Minute
+	if local.Weekday() != wd || sinceMidnight < at || st.LastWeekly == today.Format("2006-01-02") {
+		return st, nil
+	}
+	logf("weekly summary, posting...")
+	day := DayInfo{Date: today.Format("2006-01-02")}
+	var errs []error
+	for _, n := range threadReplies(notifiers, nil) {
+		groups := watched
+		if f, ok := n.(groupFilter); ok && f.onlyGroups() != nil {
+			groups = f.onlyGroups()
+		}
+		if err := deliver(ctx, n, day, weeklyText(st, today, groups)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		metrics.postErrors.Add(1)
+		return st, errors.Join(errs...)
+	}
+	st.LastWeekly = day.Date
+	return st, nil
+}
+
+// weeklyText sums each group's outage time over the seven days ending today.
+func weeklyText(st State, today time.Time, groups []groupSpec) string {
+	first := today.AddDate(0, 0, -6)
+	span := []DayInfo{{Date: first.Format("2006-01-02")}, {Date: today.Format("2006-01-02")}}
+	lines := []string{fmt.Sprintf("*підсумок тижня %s*", escapeMarkdownV2(rangeDM(span)))}
+	known := 0
+	totals := map[string]int{}
+	for d := first; !d.After(today); d = d.AddDate(0, 0, 1) {
+		mins, ok := st.Totals[d.Format("2006-01-02")]
+		if !ok {
+			continue
+		}
+		known++
+		for name, m := range mins {
+			totals[name] += m
+		}
+	}
+	for _, g := range groups {
+		text := "без відключень"
+		if totals[g.Name] > 0 {
+			text = schedule.FormatDuration(totals[g.Name])
+		}
+		lines = append(lines, fmt.Sprintf("%s %s: %s", g.Emoji, escapeMarkdownV2(groupNumber(g.Name)), text))
+	}
+	if known < 7 {
+		lines = append(lines, fmt.Sprintf("_дані є за %d дн\\. з 7_", known))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// digestAt returns the time of day of the daily digest: POWERBOT_DIGEST_AT
+// (HH:MM), which also holds back the regular posts (hold), or else the
+// POWERBOT_DAILY_DIGEST hour. at is negative when neither is set.
+func digestAt() (at time.Duration, hold bool) {
+	if v := os.Getenv(digestAtEnv); v != "" {
+		t, err := time.Parse("15:04", v)
+		if err == nil {
+			return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, true
+		}
+		logf("warning: invalid %s %q, posting changes right away", digestAtEnv, v)
+	}
+	if v := os.Getenv(dailyDigestEnv); v != "" {
+		hour, err := strconv.Atoi(v)
+		if err == nil && hour >= 0 && hour <= 23 {
+			return time.Duration(hour) * time.Hour, false
+		}
+		logf("warning: invalid %s %q, digest disabled", dailyDigestEnv, v)
+	}
+	return -1, false
+}
+
+// postDigest posts today's and tomorrow's known schedules once a day from
+// the time of day at on, changed or not, skipping days this run already
+// posted.
+func postDigest(ctx context.Context, now time.Time, at time.Duration, st State, posted map[string]bool, notifiers []Notifier) (State, error) {
+	if at < 0 || len(notifiers) == 0 {
+		return st, nil
+	}
+	loc := kyivLocation()
+	today := startOfDay(now)
+	local := now.In(loc)
+	sinceMidnight := time.Duration(local.Hour())*time.Hour + time.Duration(local.Minute())*time.Minute
+	if sinceMidnight < at || st.LastDigest == today.Format("2006-01-02") {
+		return st, nil
+	}
+	days := map[string]bool{
+		today.Format("2006-01-02"):                  true,
+		today.AddDate(0, 0, 1).Format("2006-01-02"): true,
+	}
+	var due []DayInfo
+	for _, day := range st.Days {
+		if days[day.Date] && !posted[dayKey(day)] {
+			due = append(due, day)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].Date < due[j].Date })
+	var errs []error
+	for _, run := range dayRuns(due) {
+		var err error
+		if len(run) == 1 {
+			logf("daily digest for %s, posting...", run[0].Date)
+			_, err = postSchedule(ctx, notifiers, run[0], false, 0, nil)
+		} else {
+			logf("daily digest for %s..%s (same schedule), posting...", run[0].Date, run[len(run)-1].Date)
+			_, err = postRun(ctx, notifiers, run, false, 0, nil)
+		}
+		if err != nil {
+			logKV("error", "post failed", "err", err)
+			errs = append(errs, err)
+			metrics.postErrors.Add(1)
+			continue
+		}
+		for _, day := range run {
+			st = markPosted(st, day)
+		}
+	}
+	if len(errs) > 0 {
+		return st, errors.Join(errs...)
+	}
+	st.LastDigest = today.Format("2006-01-02")
+	return st, nil
+}
+
+// runBot long-polls Telegram for commands until ctx is cancelled. It shares
+// the state file with the timer runs, so state is reloaded before and saved
+// right after each change.
+func runBot(ctx context.Context) error {
+	token := os.Getenv(tokenEnv)
+	if token == "" {
+		return fmt.Errorf("%s not set", tokenEnv)
+	}
+	statePath := os.Getenv(statePathEnv)
+	if statePath == "" {
+		statePath = defaultState
+	}
+	logf("bot: polling for commands")
+	offset := 0
+	for ctx.Err() == nil {
+		updates, err := getUpdates(ctx, token, offset)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			logKV("error", "bot: getUpdates failed", "err", err)
+			sleepCtx(ctx, botRetryDelay)
+			continue
+		}
+		for _, u := range updates {
+			offset = u.UpdateID + 1
+			if u.Message == nil || !strings.HasPrefix(u.Message.Text, "/") {
+				continue
+			}
+			chatID := strconv.FormatInt(u.Message.Chat.ID, 10)
+			reply := botCommand(statePath, chatID, u.Message.Text)
+			if reply == "" {
+				continue
+			}
+			if err := sendTelegram(ctx, token, chatID, "", reply); err != nil {
+				logKV("error", "bot: reply failed", "chat", chatID, "err", err)
+			}
+		}
+	}
+	return ctx.Err()
+}
+
+// botCommand handles one command under the state lock, so a timer run can't
+// save over the change, and returns the reply.
+func botCommand(statePath, chatID, text string) string {
+	unlock, err := lockState(statePath)
+	if err != nil {
+		logKV("error", "bot: state lock failed", "err", err)
+		return "⚠️ не вдалося зберегти, спробуйте пізніше"
+	}
+	defer unlock()
+	st, err := loadState(statePath)
+	st, reply, changed := handleCommand(st, chatID, text, time.Now())
+	if !changed {
+		return reply
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		// Saving over a corrupt or newer state would lose it.
+		logf("bot: not saving over state: %v", err)
+		return "⚠️ не вдалося зберегти, спробуйте пізніше"
+	}
+	if err := saveStateRetry(statePath, st); err != nil {
+		logKV("error", "bot: state save failed", "err", err)
+		return "⚠️ не вдалося зберегти, спробуйте пізніше"
+	}
+	return reply
+}
+
+type telegramUpdate struct {
+	UpdateID int `json:"update_id"`
+	Message  *struct {
+		Text string `json:"text"`
+		Chat struct {
+			ID int64 `json:"id"`
+		} `json:"chat"`
+	} `json:"message"`
+}
+
+// getUpdates long-polls for updates after offset.
+func getUpdates(ctx context.Context, token string, offset int) ([]telegramUpdate, error) {
+	q := fmt.Sprintf("offset=%d&timeout=%d&allowed_updates=%%5B%%22message%%22%%5D", offset, int(botPollTimeout.Seconds()))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://api.telegram.org/bot"+token+"/getUpdates?"+q, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := (&http.Client{Transport: telegramClient.Transport}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer drainClose(resp.Body)
+	if resp.StatusCode != 200 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("telegram status %d: %s", resp.StatusCode, string(body))
+	}
+	var out struct {
+		Result []telegramUpdate `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+	return out.Result, nil
+}
+
+// handleCommand applies a chat command to st and returns the reply text (empty
+// for commands we don't handle) and whether st changed.
+func handleCommand(st State, chatID, text string, now time.Time) (State, string, bool) {
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return st, "", false
+	}
+	cmd, _, _ := strings.Cut(fields[0], "@") // "/subscribe@SomeBot" in groups
+	args := fields[1:]
+	switch cmd {
+	case "/subscribe":
+		if len(args) == 0 {
+			return st, "вкажіть групу, напр\\. /subscribe " + escapeMarkdownV2(groupNumber(watched[0].Name)), false
+		}
+		g, ok := findGroup(strings.Join(args, " "))
+		if !ok {
+			var nums []string
+			for _, w := range watched {
+				nums = append(nums, groupNumber(w.Name))
+			}
+			return st, "❌ такої групи немає, доступні: " + escapeMarkdownV2(strings.Join(nums, ", ")), false
+		}
+		reply := "✅ підписано на Групу " + escapeMarkdownV2(groupNumber(g.Name))
+		for _, name := range st.Subscriptions[chatID] {
+			if name == g.Name {
+				return st, reply, false
+			}
+		}
+		if st.Subscriptions == nil {
+			st.Subscriptions = map[string][]string{}
+		}
+		st.Subscriptions[chatID] = append(st.Subscriptions[chatID], g.Name)
+		return st, reply, true
+	case "/unsubscribe":
+		if _, ok := st.Subscriptions[chatID]; !ok {
+			return st, "ви не підписані", false
+		}
+		if len(args) == 0 {
+			delete(st.Subscriptions, chatID)
+			return st, "✅ підписку скасовано", true
+		}
+		g, ok := findGroup(strings.Join(args, " "))
+		if !ok {
+			return st, "❌ такої групи немає", false
+		}
+		var kept []string
+		for _, name := range st.Subscriptions[chatID] {
+			if name != g.Name {
+				kept = append(kept, name)
+			}
+		}
+		if len(kept) == 0 {
+			delete(st.Subscriptions, chatID)
+		} else {
+			st.Subscriptions[chatID] = kept
+		}
+		return st, "✅ відписано від Групи " + escapeMarkdownV2(groupNumber(g.Name)), true
+	case "/today":
+		reply := todayReply(st, chatID, now)
+		if day, _ := todaySchedule(st, now); day != nil && os.Getenv(trackSeenEnv) != "" && needsUpdate(st, chatID, *day) {
+			return markSeen(st, chatID, *day), reply, true
+		}
+		return st, reply, false
+	case "/week":
+		return st, weekReply(st, chatID), false
+	case "/status":
+		return st, statusReply(st, chatID, now), false
+	}
+	return st, "", false
+}
+
+// weekReply lists every stored day as one compact line, oldest first.
+func weekReply(st State, chatID string) string {
+	if len(st.Days) == 0 {
+		return "збережених графіків немає"
+	}
+	days := append([]DayInfo(nil), st.Days...)
+	sort.Slice(days, func(i, j int) bool { return days[i].Date < days[j].Date })
+	groups := chatGroups(st, chatID)
+	lines := make([]string, 0, len(days))
+	for _, d := range days {
+		lines = append(lines, compactLine(d, schedule.ToDM(d.Date), false, 0, nil, groups))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// statusReply renders every stored day from today on in full for the chat's
+// groups, the same lines the channel posts use.
+func statusReply(st State, chatID string, now time.Time) string {
+	today := startOfDay(now).Format("2006-01-02")
+	var days []DayInfo
+	for _, d := range st.Days {
+		if d.Date >= today {
+			days = append(days, d)
+		}
+	}
+	if len(days) == 0 {
+		return "актуальних графіків немає"
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Date < days[j].Date })
+	return daySections(days, chatGroups(st, chatID))
+}
+
+// daySections renders days (sorted by date) as "*графік на DD.MM*" blocks.
+// With POWERBOT_COMBINE_DAYS consecutive days with the same schedule share
+// one block headed by their date range.
+func daySections(days []DayInfo, groups []groupSpec) string {
+	var blocks []string
+	for _, run := range dayRuns(days) {
+		lines := []string{fmt.Sprintf("*графік на %s*", escapeMarkdownV2(rangeDM(run)))}
+		for _, g := range groups {
+			lines = append(lines, formatLine(run[0], g.Name, g.Label, maxIntervals))
+		}
+		blocks = append(blocks, strings.Join(lines, "\n"))
+	}
+	return strings.Join(blocks, "\n\n")
+}
+
+// dayRuns groups days (sorted by date) with combineDays under
+// POWERBOT_COMBINE_DAYS, and one day per run otherwise.
+func dayRuns(days []DayInfo) [][]DayInfo {
+	if os.Getenv(combineDaysEnv) != "" {
+		return combineDays(days)
+	}
+	var runs [][]DayInfo
+	for _, d := range days {
+		runs = append(runs, []DayInfo{d})
+	}
+	return runs
+}
+
+// combineDays splits days (sorted by date) into runs of consecutive dates
+// whose watched groups have the same outage windows.
+func combineDays(days []DayInfo) [][]DayInfo {
+	var runs [][]DayInfo
+	for i, d := range days {
+		if i > 0 {
+			run := runs[len(runs)-1]
+			last := run[len(run)-1]
+			prev, err1 := time.Parse("2006-01-02", last.Date)
+			cur, err2 := time.Parse("2006-01-02", d.Date)
+			if err1 == nil && err2 == nil && prev.AddDate(0, 0, 1).Equal(cur) && last.Region == d.Region && sameDay(last, d) {
+				runs[len(runs)-1] = append(run, d)
+				continue
+			}
+		}
+		runs = append(runs, []DayInfo{d})
+	}
+	return runs
+}
+
+// sameDay reports whether a and b list the same watched groups with the same
+// outage windows (and the same images, for days published as pictures).
+func sameDay(a, b DayInfo) bool {
+	if !slices.Equal(a.Images, b.Images) {
+		return false
+	}
+	for _, g := range watched {
+		ga, okA := a.Groups[g.Name]
+		gb, okB := b.Groups[g.Name]
+		if okA != okB || okA && !schedule.SameSchedule(ga.Text, gb.Text) {
+			return false
+		}
+	}
+	return true
+}
+
+// rangeDM formats the dates of a run as DD.MM, or as "12–13.12" (or
+// "31.12–01.01" across months) for several days.
+func rangeDM(run []DayInfo) string {
+	first, last := schedule.ToDM(run[0].Date), schedule.ToDM(run[len(run)-1].Date)
+	if len(run) == 1 {
+		return first
+	}
+	if first[2:] == last[2:] {
+		return first[:2] + "–" + last
+	}
+	return first + "–" + last
+}
+
+// chatGroups returns the watched groups chatID subscribed to, or all of them.
+func chatGroups(st State, chatID string) []groupSpec {
+	names := st.Subscriptions[chatID]
+	if len(names) == 0 {
+		return watched
+	}
+	var groups []groupSpec
+	for _, g := range watched {
+		for _, name := range names {
+			if name == g.Name {
+				groups = append(groups, g)
+			}
+		}
+	}
+	return groups
+}
+
+// todayReply renders today's stored schedule for the chat's subscribed groups
+// (or all watched groups), with the time to the next outage boundary.
+func todayReply(st State, chatID string, now time.Time) string {
+	day, mins := todaySchedule(st, now)
+	if day == nil {
+		return "графіка на сьогодні ще немає"
+	}
+	lines := []string{fmt.Sprintf("*графік на %s*", escapeMarkdownV2(schedule.ToDM(day.Date)))}
+	for _, g := range chatGroups(st, chatID) {
+		lines = append(lines, formatLine(*day, g.Name, g.Label, maxIntervals))
+		if left, inOutage, ok := nextBoundary(day.Groups[g.Name].Text, mins); ok {
+			what := "відключення "
+			if inOutage {
+				what = "увімкнення "
+			}
+			lines = append(lines, "   "+what+relativeTime(time.Duration(left)*time.Minute))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// todaySchedule returns today's stored day (nil if none) and the local time
+// of day in minutes.
+func todaySchedule(st State, now time.Time) (*DayInfo, int) {
+	loc := kyivLocation()
+	now = now.In(loc)
+	date := startOfDay(now).Format("2006-01-02")
+	mins := now.Hour()*60 + now.Minute()
+	for i := range st.Days {
+		if st.Days[i].Date == date {
+			return &st.Days[i], mins
+		}
+	}
+	return nil, mins
+}
+
+// nextBoundary returns the minutes from mins (since midnight) to the next
+// outage start, or to the end of the outage in progress when inOutage.
+func nextBoundary(text string, mins int) (left int, inOutage, ok bool) {
+	for _, iv := range schedule.MergeIntervals(schedule.IntervalSet(text)) {
+		if mins < iv.Start {
+			return iv.Start - mins, false, true
+		}
+		if mins < iv.End {
+			return iv.End - mins, true, true
+		}
+	}
+	return 0, false, false
+}
+
+// countdownText is the pinned countdown: per watched group, the time left
+// until the next outage ("до вимкнення") or until it ends ("до ввімкнення").
+func countdownText(st State, now time.Time) string {
+	day, mins := todaySchedule(st, now)
+	if day == nil {
+		return "⏳ графіка на сьогодні ще немає"
+	}
+	lines := []string{fmt.Sprintf("*⏳ %s*", escapeMarkdownV2(schedule.ToDM(day.Date)))}
+	for _, g := range watched {
+		line := g.Emoji + " сьогодні більше без вимкнень"
+		if _, ok := day.Groups[g.Name]; !ok {
+			line = g.Emoji + " " + escapeMarkdownV2(notFoundText())
+		} else if left, inOutage, ok := nextBoundary(day.Groups[g.Name].Text, mins); ok {
+			what := " до вимкнення: "
+			if inOutage {
+				what = " до ввімкнення: "
+			}
+			line = g.Emoji + what + schedule.FormatDuration(left)
+		}
+		lines = append(lines, line)
+	}
+	text := strings.Join(lines, "\n")
+	if os.Getenv(pinAllDaysEnv) != "" {
+		if days := boardDays(st, now); len(days) > 0 {
+			text += "\n\n" + daySections(days, watched)
+		}
+	}
+	return text
+}
+
+// boardDays returns the stored days in the lookahead window (today through
+// POWERBOT_LOOKAHEAD_DAYS ahead) by date, changed or not, for the pinned
+// message with POWERBOT_PIN_ALL_DAYS.
+func boardDays(st State, now time.Time) []DayInfo {
+	dates := checkDates(startOfDay(now))
+	first, last := dates[0].Format("2006-01-02"), dates[len(dates)-1].Format("2006-01-02")
+	var days []DayInfo
+	for _, d := range st.Days {
+		if d.Date >= first && d.Date <= last {
+			days = append(days, d)
+		}
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Date < days[j].Date })
+	return days
+}
+
+// pinState is the countdown message currently pinned and the text it shows,
+// so an unchanged countdown isn't edited again.
+type pinState struct {
+	Chat      string `json:"chat"`
+	MessageID int    `json:"message_id"`
+	Text      string `json:"text"`
+}
+
+// updatePin keeps a pinned countdown message in the primary chat current,
+// editing it in place and posting (and pinning) a new one if it's gone.
+func updatePin(ctx context.Context, st State, now time.Time) State {
+	chats := chatIDs()
+	if len(chats) == 0 {
+		return st
+	}
+	chatID := chats[0]
+	t, ok := newTelegramNotifier(chatID)
+	if !ok {
+		return st
+	}
+	text := countdownText(st, now)
+	if p := st.Pin; p != nil && p.Chat == chatID && p.MessageID != 0 {
+		if p.Text == text {
+			return st
+		}
+		payload := messagePayload(chatID, "", text)
+		payload["message_id"] = p.MessageID
+		err := telegramAPI(ctx, t.token, "editMessageText", payload, nil)
+		var te *telegramError
+		switch {
+		case err == nil, errors.As(err, &te) && strings.Contains(te.body, "message is not modified"):
+			st.Pin = &pinState{Chat: chatID, MessageID: p.MessageID, Text: text}
+			return st
+		case errors.As(err, &te) && strings.Contains(te.body, "message to edit not found"):
+			logf("countdown pin %d is gone, posting a new one: %v", p.MessageID, err)
+		default:
+			logKV("error", "countdown pin edit failed", "err", err)
+			return st
+		}
+	}
+	var msg struct {
+		MessageID int `json:"message_id"`
+	}
+	if err := telegramAPI(ctx, t.token, "sendMessage", messagePayload(chatID, t.thread, text), &msg); err != nil {
+		logKV("error", "countdown pin post failed", "err", err)
+		return st
+	}
+	pin := map[string]any{"chat_id": chatID, "message_id": msg.MessageID, "disable_notification": true}
+	if err := telegramAPI(ctx, t.token, "pinChatMessage", pin, nil); err != nil {
+		logKV("error", "countdown pin failed", "err", err)
+	}
+	st.Pin = &pinState{Chat: chatID, MessageID: msg.MessageID, Text: text}
+	return st
+}
+
+// groupNumberRe matches a bare group number such as "6.1".
+var groupNumberRe = regexp.MustCompile(`^\d+\.\d+$`)
+
+// groupByName returns the known spec for name, or a power group labelled with
+// the name itself.
+func groupByName(name string) groupSpec {
+	for _, known := range knownGroups {
+		if known.Name == name {
+			return known
+		}
+	}
+	return groupSpec{Name: name, Label: fmt.Sprintf("*%s %s*", emojiPower, escapeMarkdownV2(name)), Emoji: emojiPower}
+}
+
+// findGroup resolves "6.1", "Група 6.1" or "power" to a watched group.
+func findGroup(arg string) (groupSpec, bool) {
+	arg = strings.TrimSpace(arg)
+	for key, known := range knownGroups {
+		if strings.EqualFold(arg, key) {
+			arg = known.Name
+		}
+	}
+	for _, g := range watched {
+		if arg == g.Name || arg == groupNumber(g.Name) {
+			return g, true
+		}
+	}
+	return groupSpec{}, false
+}
+
+// groupNumber strips the "Група" prefix: "Група 6.1" -> "6.1".
+func groupNumber(name string) string {
+	return strings.TrimSpace(strings.TrimPrefix(name, "Група"))
+}
+
+// subscriberNotifiers turns /subscribe entries into Telegram destinations
+// that only get their own groups.
+func subscriberNotifiers(st State) []Notifier {
+	chats := make([]string, 0, len(st.Subscriptions))
+	for chatID := range st.Subscriptions {
+		chats = append(chats, chatID)
+	}
+	sort.Strings(chats)
+	var out []Notifier
+	for _, chatID := range chats {
+		only := []groupSpec{}
+		for _, g := range watched {
+			for _, name := range st.Subscriptions[chatID] {
+				if name == g.Name {
+					only = append(only, g)
+				}
+			}
+		}
+		if t, ok := newTelegramNotifier(chatID); ok && len(only) > 0 {
+			t.only = only
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// sleepCtx waits for d or until ctx is done.
+func sleepCtx(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+	case <-t.C:
+	}
+}
+
+// scenarioStep is one point in time of a -simulate scenario. The page is
+// given inline as rawHtml or as a file path relative to the scenario.
+type scenarioStep struct {
+	Time    string `json:"time"` // RFC 3339
+	RawHTML string `json:"rawHtml"`
+	File    string `json:"file"`
+}
+
+type recordedPost struct {
+	At   time.Time
+	Kind string
+	Date string
+	Msg  string
+}
+
+// recorder collects everything process() would have sent.
+type recorder struct {
+	now   time.Time
+	posts []recordedPost
+}
+
+type recordingNotifier struct {
+	r    *recorder
+	kind string
+}
+
+func (n recordingNotifier) Notify(_ context.Context, day DayInfo, msg string) error {
+	n.r.posts = append(n.r.posts, recordedPost{At: n.r.now, Kind: n.kind, Date: day.Date, Msg: msg})
+	return nil
+}
+
+// printNotifier writes posts to w; used by dry-run mode.
+type printNotifier struct {
+	w    io.Writer
+	kind string
+}
+
+func (n printNotifier) Notify(_ context.Context, day DayInfo, msg string) error {
+	_, err := fmt.Fprintf(n.w, "--- %s %s ---\n%s\n\n", n.kind, schedule.ToDM(day.Date), msg)
+	return err
+}
+
+// simulate replays a scenario through process() with in-memory state and a
+// recording notifier, then prints every post in order.
+func simulate(ctx context.Context, path string, w io.Writer) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var steps []scenarioStep
+	if err := json.Unmarshal(b, &steps); err != nil {
+		return fmt.Errorf("parse scenario: %w", err)
+	}
+	rec := &recorder{}
+	notifiers := []Notifier{recordingNotifier{r: rec, kind: "post"}}
+	alerts := recordingNotifier{r: rec, kind: "alert"}
+	var st State
+	for i, step := range steps {
+		now, err := time.Parse(time.RFC3339, step.Time)
+		if err != nil {
+			return fmt.Errorf("step %d: %w", i+1, err)
+		}
+		body := step.RawHTML
+		if step.File != "" {
+			fb, err := os.ReadFile(filepath.Join(filepath.Dir(path), step.File))
+			if err != nil {
+				return fmt.Errorf("step %d: %w", i+1, err)
+			}
+			var updated time.Time
+			if body, updated, err = pageBody(fb); err != nil {
+				return fmt.Errorf("step %d: %s: %w", i+1, step.File, err)
+			}
+			st.SourceUpdated = feedTime(updated)
+		}
+		rec.now = now
+		var parsed []DayInfo
+		posted := map[string]bool{}
+		st, parsed, _ = process(ctx, now, body, st, notifiers, alerts, nil, posted)
+		st, _ = periodic(ctx, st, now, posted, notifiers)
+		st = checkParseHealth(ctx, st, parsed, now, alerts)
+	}
+	loc := kyivLocation()
+	for _, p := range rec.posts {
+		fmt.Fprintf(w, "%s %s %s\n%s\n\n", p.At.In(loc).Format("2006-01-02 15:04"), p.Kind, schedule.ToDM(p.Date), p.Msg)
+	}
+	fmt.Fprintf(w, "%d steps, %d posts\n", len(steps), len(rec.posts))
+	return nil
+}
+
+// errNotModified is returned by loadContent when a conditional GET got a 304.
+var errNotModified = errors.New("not modified")
+
+// validators are the HTTP cache validators of every fetched page, plus the
+// feed's own update time (zero if it gives none).
+type validators struct {
+	Pages   []pageCache
+	Updated time.Time
+}
+
+// pageCache is one API page's URL and the ETag and Last-Modified it was
+// served with.
+type pageCache struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// dumpHTML writes the fetched rawHtml to dir, creating it if needed, as
+// powerbot-<UTC time>.html and removes the oldest dumps beyond
+// POWERBOT_DUMP_KEEP (default 20). UTC with nanoseconds keeps the names
+// unique and in order across the DST fall-back hour.
+func dumpHTML(dir, body string, now time.Time) error {
+	keep := defaultDumpKeep
+	if s := os.Getenv(dumpKeepEnv); s != "" {
+		if n, err := strconv.Atoi(s); err != nil || n < 1 {
+			logf("warning: invalid %s %q, using %d", dumpKeepEnv, s, defaultDumpKeep)
+		} else {
+			keep = n
+		}
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	name := "powerbot-" + now.UTC().Format("20060102-150405.000000000") + "Z.html"
+	if err := writeFileAtomic(filepath.Join(dir, name), []byte(body)); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	// The timestamp sorts lexically, and ReadDir returns names in order.
+	var dumps []string
+	for _, e := range entries {
+		if n := e.Name(); !e.IsDir() && strings.HasPrefix(n, "powerbot-") && strings.HasSuffix(n, ".html") {
+			dumps = append(dumps, n)
+		}
+	}
+	for len(dumps) > keep {
+		if err := os.Remove(filepath.Join(dir, dumps[0])); err != nil {
+			return err
+		}
+		dumps = dumps[1:]
+	}
+	return nil
+}
+
+func loadContent(ctx context.Context, st State) (string, validators, error) {
+	var v validators
+	debug := os.Getenv(debugEnv) != ""
+	if path := os.Getenv(testJSONEnv); path != "" {
+		b, err := os.ReadFile(path)
+		if debug {
+			logf("debug: reading API response from test file: %s", path)
+		}
+		if err != nil {
+			return "", v, err
+		}
+		body, updated, err := extractRawHTML(b)
+		v.Updated = updated
+		return body, v, err
+	}
+	if path := os.Getenv(testFileEnv); path != "" {
+		b, err := os.ReadFile(path)
+		if debug {
+			logf("debug: reading from test file: %s", path)
+		}
+		if err != nil {
+			return "", v, err
+		}
+		body, updated, err := pageBody(b)
+		v.Updated = updated
+		return body, v, err
+	}
+	maxPages := defaultMaxPages
+	if s := os.Getenv(maxPagesEnv); s != "" {
+		if n, err := strconv.Atoi(s); err != nil || n < 1 {
+			logf("warning: invalid %s %q, using %d", maxPagesEnv, s, defaultMaxPages)
+		} else {
+			maxPages = n
+		}
+	}
+	// Revalidate every page of the last fetch. Only when all of them are
+	// unchanged is the run skipped; otherwise the pages that did change are
+	// reused below and the rest fetched again.
+	changed := map[string][]byte{}
+	cached := map[string]pageCache{}
+	if len(st.Pages) > 0 && st.Pages[0].URL == fetchURL {
+		for _, pc := range st.Pages {
+			b, pv, err := fetchPage(ctx, pc.URL, &pc)
+			if errors.Is(err, errNotModified) {
+				continue
+			}
+			if err != nil {
+				return "", v, err
+			}
+			changed[pc.URL] = b
+			cached[pc.URL] = pv
+		}
+		if len(changed) == 0 {
+			return "", v, errNotModified
+		}
+		if debug {
+			logf("debug: %d of %d API pages changed", len(changed), len(st.Pages))
+		}
+	}
+	// The schedule can be pushed off page 1 by newer menus, so follow
+	// hydra:next until a page comes back empty and join what every page has.
+	var parts []string
+	next := fetchURL
+	for page := 1; next != ""; page++ {
+		if page > maxPages {
+			logf("warning: API has more than %d pages, stopping (raise %s)", maxPages, maxPagesEnv)
+			break
+		}
+		b, pv := changed[next], cached[next]
+		if b == nil {
+			if debug {
+				logf("debug: fetching from URL: %s", next)
+			}
+			var err error
+			if b, pv, err = fetchPage(ctx, next, nil); err != nil {
+				return "", v, err
+			}
+		}
+		v.Pages = append(v.Pages, pv)
+		if debug {
+			logf("debug: received %d bytes from API (page %d)", len(b), page)
+		}
+		p, err := parseAPIPage(b)
+		if err != nil {
+			return "", v, err
+		}
+		if p.raw != "" {
+			parts = append(parts, p.raw)
+		}
+		if p.updated.After(v.Updated) {
+			v.Updated = p.updated
+		}
+		cur := next
+		next = ""
+		if p.next != "" && p.members > 0 {
+			base, _ := url.Parse(cur)
+			if u, err := base.Parse(p.next); err == nil && u.String() != cur {
+				next = u.String()
+			}
+		}
+	}
+	if len(parts) == 0 {
+		return "", v, fmt.Errorf("no rawHtml found in API response")
+	}
+	return strings.Join(parts, "\n"), v, nil
+}
+
+// fetchPage GETs one API page. With cached set it sends that page's stored
+// validators and reports errNotModified on a 304.
+func fetchPage(ctx context.Context, u string, cached *pageCache) ([]byte, pageCache, error) {
+	v := pageCache{URL: u}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, v, err
+	}
+	// Some CDNs only send Last-Modified; prefer the ETag when we have both.
+	if cached != nil && cached.ETag != "" {
+		req.Header.Set("If-None-Match", cached.ETag)
+	} else if cached != nil && cached.LastModified != "" {
+		req.Header.Set("If-Modified-Since", cached.LastModified)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, v, err
+	}
+	defer drainClose(resp.Body)
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, v, errNotModified
+	}
+	if resp.StatusCode != 200 {
+		return nil, v, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	v.ETag = resp.Header.Get("ETag")
+	v.LastModified = resp.Header.Get("Last-Modified")
+	b, err := io.ReadAll(resp.Body)
+	return b, v, err
+}
+
+// pageBody returns the page in a saved file: a full API dump (JSON) goes
+// through the same extraction as a live fetch, anything else is the page.
+func pageBody(b []byte) (string, time.Time, error) {
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("{")) {
+		if os.Getenv(debugEnv) != "" {
+			logf("debug: test file looks like an API JSON response")
+		}
+		return extractRawHTML(b)
+	}
+	return string(b), time.Time{}, nil
+}
+
+// extractRawHTML pulls the first non-empty rawHtml out of an API response,
+// with the updatedAt of its menu item (or else of the menu) when present.
+func extractRawHTML(b []byte) (string, time.Time, error) {
+	p, err := parseAPIPage(b)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if p.raw == "" {
+		return "", time.Time{}, fmt.Errorf("no rawHtml found in API response")
+	}
+	return p.raw, p.updated, nil
+}
+
+// apiPage is what one page of the API response yields: its first non-empty
+// rawHtml (decoded), that item's update time, the hydra:next link and how
+// many members it listed.
+type apiPage struct {
+	raw     string
+	updated time.Time
+	next    string
+	members int
+}
+
+func parseAPIPage(b []byte) (apiPage, error) {
+	var p apiPage
+	debug := os.Getenv(debugEnv) != ""
+
+	// Parse JSON response
+	var apiResponse struct {
+		HydraMember []struct {
+			UpdatedAt string `json:"updatedAt"`
+			MenuItems []struct {
+				Name      string `json:"name"`
+				RawHtml   string `json:"rawHtml"`
+				UpdatedAt string `json:"updatedAt"`
+			} `json:"menuItems"`
+		} `json:"hydra:member"`
+		View struct {
+			Next string `json:"hydra:next"`
+		} `json:"hydra:view"`
+	}
+	if err := json.Unmarshal(b, &apiResponse); err != nil {
+		if debug {
+			logf("debug: JSON unmarshal error: %v", err)
+			logf("debug: response preview (first 500 chars): %s", string(b[:min(500, len(b))]))
+		}
+		return p, fmt.Errorf("failed to parse API response: %w", err)
+	}
+	p.next, p.members = apiResponse.View.Next, len(apiResponse.HydraMember)
+
+	// Extract rawHtml from menuItems. Normally the first non-empty one is the
+	// schedule; when several carry schedule headers, one per region, each is
+	// kept behind a region marker named after its menu item.
+	var regions []string
+	for _, member := range apiResponse.HydraMember {
+		for _, item := range member.MenuItems {
+			if item.RawHtml == "" {
+				continue
+			}
+			if debug {
+				logf("debug: extracted rawHtml from menu item '%s' (%d bytes)", item.Name, len(item.RawHtml))
+			}
+			raw, fixed := decodeRawHTML(item.RawHtml)
+			if fixed {
+				logf("rawHtml was double-encoded, decoded it")
+			}
+			var updated time.Time
+			for _, v := range []string{item.UpdatedAt, member.UpdatedAt} {
+				if t, err := time.Parse(time.RFC3339, v); err == nil {
+					updated = t
+					break
+				}
+			}
+			if p.raw == "" {
+				p.raw, p.updated = raw, updated
+			}
+			if _, ok := schedule.LatestHeader(raw); ok {
+				regions = append(regions, regionMarker(item.Name)+raw)
+				if updated.After(p.updated) {
+					p.updated = updated
+				}
+			}
+		}
+	}
+	if len(regions) > 1 {
+		p.raw = strings.Join(regions, "\n")
+	}
+	return p, nil
+}
+
+// regionMarkerRe matches the marker parseAPIPage puts before each region's
+// schedule when the feed has several.
+var regionMarkerRe = regexp.MustCompile(`<!-- powerbot-region: (.*?) -->`)
+
+func regionMarker(name string) string {
+	name = strings.Join(strings.Fields(strings.ReplaceAll(name, "--", "-")), " ")
+	return "<!-- powerbot-region: " + name + " -->"
+}
+
+// regionSections splits body at region markers. Whatever comes before the
+// first marker, usually the whole body, belongs to region def.
+func regionSections(body, def string) (regions, bodies []string) {
+	marks := regionMarkerRe.FindAllStringSubmatchIndex(body, -1)
+	if len(marks) == 0 {
+		return []string{def}, []string{body}
+	}
+	if head := body[:marks[0][0]]; strings.TrimSpace(head) != "" {
+		regions, bodies = append(regions, def), append(bodies, head)
+	}
+	for i, m := range marks {
+		if len(m) < 4 {
+			continue
+		}
+		end := len(body)
+		if i+1 < len(marks) {
+			end = marks[i+1][0]
+		}
+		regions = append(regions, body[m[2]:m[3]])
+		bodies = append(bodies, body[m[1]:end])
+	}
+	return regions, bodies
+}
+
+// doubleEntityRe matches an entity whose "&" was itself escaped, e.g.
+// "&amp;nbsp;".
+var doubleEntityRe = regexp.MustCompile(`&amp;(#?[0-9A-Za-z]+;)`)
+
+// decodeRawHTML undoes a second layer of encoding some LOE serializers put on
+// rawHtml: markup escaped as a whole ("&lt;b&gt;", or "\u003cb\u003e" left
+// over from encoding the JSON twice) or escaped entities ("&amp;nbsp;").
+// fixed reports whether anything was decoded.
+func decodeRawHTML(raw string) (out string, fixed bool) {
+	for i := 0; i < 3; i++ { // at most a few layers; stop as soon as it is clean
+		switch {
+		case strings.Contains(raw, `\u003c`) || strings.Contains(raw, `\u003C`):
+			var s string
+			if err := json.Unmarshal([]byte(`"`+raw+`"`), &s); err != nil {
+				return raw, fixed
+			}
+			raw = s
+		case !strings.Contains(raw, "<") && strings.Contains(raw, "&lt;"):
+			raw = html.UnescapeString(raw)
+		case doubleEntityRe.MatchString(raw):
+			raw = doubleEntityRe.ReplaceAllString(raw, "&$1")
+		default:
+			return raw, fixed
+		}
+		fixed = true
+	}
+	return raw, fixed
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// unrecognizedDay is a date whose section was found but held none of our groups.
+type unrecognizedDay struct {
+	Date    string
+	Region  string
+	Present []string // group labels that were in the section
+}
+
+// dropFarFuture discards days more than POWERBOT_MAX_FUTURE_DAYS after today;
+// such a date points at a parser bug (e.g. a wrong year), not a real preview.
+func dropFarFuture(days []DayInfo, today time.Time) []DayInfo {
+	limit := defaultMaxFuture
+	if v := os.Getenv(maxFutureEnv); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			logf("warning: invalid %s %q, using %d", maxFutureEnv, v, defaultMaxFuture)
+		} else {
+			limit = n
+		}
+	}
+	last := today.AddDate(0, 0, limit).Format("2006-01-02")
+	var out []DayInfo
+	for _, d := range days {
+		if d.Date > last {
+			logf("warning: ignoring schedule for %s, more than %d days ahead", d.Date, limit)
+			continue
+		}
+		out = append(out, d)
+	}
+	return out
+}
+
+// parsePage uses regex-based extraction; assumes stable, simple HTML/text.
+func parsePage(body string, dates []time.Time) ([]DayInfo, []unrecognizedDay, error) {
+	p := newParser()
+	var out []DayInfo
+	var unrecognized []unrecognizedDay
+	debug := os.Getenv(debugEnv) != ""
+	if debug {
+		// Save first 2000 chars for inspection
+		preview := body
+		if len(preview) > 2000 {
+			preview = preview[:2000]
+		}
+		logf("debug: HTML preview (first 2000 chars):\n%s", preview)
+		// Check if we can find the date pattern at all
+		datePat := regexp.MustCompile(`Графік погодинних відключень на\s+\d{2}\.\d{2}\.\d{4}`)
+		matches := datePat.FindAllString(body, -1)
+		logf("debug: found %d date headers: %v", len(matches), matches)
+	}
+	body = schedule.CollapseSpace(body)
+	regions, bodies := regionSections(body, p.Region)
+	for i := range bodies {
+		p.Region = regions[i]
+		days, unrec := parseDates(p, bodies[i], dates)
+		out = append(out, days...)
+		unrecognized = append(unrecognized, unrec...)
+	}
+	return out, unrecognized, nil
+}
+
+// parseDates extracts each of dates from one region's part of the page.
+func parseDates(p schedule.Parser, body string, dates []time.Time) ([]DayInfo, []unrecognizedDay) {
+	var out []DayInfo
+	var unrecognized []unrecognizedDay
+	type parsed struct {
+		day     DayInfo
+		present []string
+		err     error
+	}
+	// Each date is extracted independently; results land at the date's
+	// index so the output order never depends on scheduling.
+	results := make([]parsed, len(dates))
+	parseOne := func(i int) {
+		day, present, err := p.ParseDay(body, dates[i])
+		results[i] = parsed{day, present, err}
+	}
+	if n := parseConcurrency(); n > 1 && len(dates) > 1 {
+		idx := make(chan int)
+		var wg sync.WaitGroup
+		for w := 0; w < n && w < len(dates); w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range idx {
+					parseOne(i)
+				}
+			}()
+		}
+		for i := range dates {
+			idx <- i
+		}
+		close(idx)
+		wg.Wait()
+	} else {
+		for i := range dates {
+			parseOne(i)
+		}
+	}
+	for i, r := range results {
+		if r.err != nil {
+			logKV("error", "parse failed", "date", dates[i].Format("2006-01-02"), "err", r.err)
+			metrics.parseErrors.Add(1)
+			continue
+		}
+		if len(r.day.Groups) > 0 || len(r.day.Images) > 0 {
+			out = append(out, r.day)
+		} else if r.present != nil {
+			unrecognized = append(unrecognized, unrecognizedDay{Date: r.day.Date, Region: r.day.Region, Present: r.present})
+		}
+	}
+	return out, unrecognized
+}
+
+// parseConcurrency returns how many dates parsePage may extract at once;
+// 1 (the default) keeps the loop sequential.
+func parseConcurrency() int {
+	v := os.Getenv(parseConcurrencyEnv)
+	if v == "" {
+		return 1
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		logf("warning: invalid %s %q, parsing sequentially", parseConcurrencyEnv, v)
+		return 1
+	}
+	return n
+}
+
+// newParser configures the schedule parser from the watched groups and env.
+func newParser() schedule.Parser {
+	loc := kyivLocation()
+	p := schedule.Parser{
+		Region:     os.Getenv(regionEnv),
+		StripEmoji: os.Getenv(stripEmojiEnv) != "",
+		Location:   loc,
+	}
+	for _, g := range watched {
+		p.Groups = append(p.Groups, g.Name)
+	}
+	if v := os.Getenv(availablePhrasesEnv); v != "" {
+		p.AvailablePhrases = strings.Split(v, ",")
+	}
+	if v := os.Getenv(footerMarkersEnv); v != "" {
+		p.FooterMarkers = strings.Split(v, ",")
+	}
+	if v := os.Getenv(terminatorsEnv); v != "" {
+		p.Terminators = strings.Split(v, ",")
+	}
+	if os.Getenv(debugEnv) != "" {
+		p.Debugf = func(format string, args ...any) { logf("debug: "+format, args...) }
+	}
+	return p
+}
+
+// StateStore persists State in one encoding.
+type StateStore interface {
+	Load() (State, error)
+	Save(State) error
+}
+
+// storeFor picks the backend for path: gob when POWERBOT_STATE_FORMAT=gob or
+// the file ends in ".gob", JSON otherwise.
+func storeFor(path string) StateStore {
+	if strings.EqualFold(os.Getenv(stateFormatEnv), "gob") || strings.EqualFold(filepath.Ext(path), ".gob") {
+		return gobStore{path: path}
+	}
+	return jsonStore{path: path}
+}
+
+// stateVersion is the State layout this build writes.
+const stateVersion = 1
+
+var (
+	errStateCorrupt = errors.New("state file corrupt")
+	errStateVersion = errors.New("state file from a newer version")
+)
+
+// loadState reads path. A file that exists but doesn't decode (e.g. truncated
+// by a crash or a full disk) is reported as errStateCorrupt, so the caller
+// can tell it from a first run. The file is left in place: until a rebuilt
+// state replaces it, the next run must see it as corrupt again, not missing.
+func loadState(path string) (State, error) {
+	st, err := storeFor(path).Load()
+	var pathErr *fs.PathError
+	if err == nil || errors.As(err, &pathErr) {
+		if err == nil && st.Version > stateVersion {
+			return State{}, fmt.Errorf("%w: %s is version %d, this build knows %d", errStateVersion, path, st.Version, stateVersion)
+		}
+		return st, err
+	}
+	logf("error: state file %s is corrupt: %v", path, err)
+	return State{}, fmt.Errorf("%w: %v", errStateCorrupt, err)
+}
+
+// keepCorrupt copies the corrupt state file at path to path+".bad" for
+// inspection, right before a rebuilt state is saved over it.
+func keepCorrupt(path string) {
+	b, err := os.ReadFile(path)
+	if err == nil {
+		err = writeFileAtomic(path+".bad", b)
+	}
+	if err != nil {
+		logf("warning: could not keep corrupt state as %s.bad: %v", path, err)
+		return
+	}
+	logf("kept corrupt state as %s.bad", path)
+}
+
+// importState copies the state at from, in whichever format it is, to
+// POWERBOT_STATE in the configured one, so switching backends doesn't start
+// from empty state and re-post everything. It won't overwrite existing state.
+func importState(from string) error {
+	to := os.Getenv(statePathEnv)
+	if to == "" {
+		to = defaultState
+	}
+	if a, b := filepath.Clean(from), filepath.Clean(to); a == b {
+		return fmt.Errorf("%s is already the state file", from)
+	}
+	if _, err := os.Stat(to); err == nil {
+		return fmt.Errorf("%s already exists; move it aside to import over it", to)
+	}
+	st, err := jsonStore{path: from}.Load()
+	var pathErr *fs.PathError
+	if err != nil && !errors.As(err, &pathErr) {
+		var gobErr error
+		if st, gobErr = (gobStore{path: from}).Load(); gobErr != nil {
+			return fmt.Errorf("%s is neither JSON (%v) nor gob (%v)", from, err, gobErr)
+		}
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	if st.Version > stateVersion {
+		return fmt.Errorf("%w: %s is version %d, this build knows %d", errStateVersion, from, st.Version, stateVersion)
+	}
+	if err := saveState(to, st); err != nil {
+		return err
+	}
+	logf("imported state from %s into %s (%d days)", from, to, len(st.Days))
+	return nil
+}
+
+func saveState(path string, st State) error {
+	st.Version = stateVersion
+	return storeFor(path).Save(st)
+}
+
+type jsonStore struct {
+	path string
+}
+
+func (s jsonStore) Load() (State, error) {
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		return State{}, err
+	}
+	if len(bytes.TrimSpace(b)) == 0 {
+		return State{}, errors.New("empty file")
+	}
+	var st State
+	err = json.Unmarshal(b, &st)
+	return st, err
+}
+
+func (s jsonStore) Save(st State) error {
+	var b []byte
+	if os.Getenv(stateCompactEnv) != "" {
+		b, _ = json.Marshal(st)
+	} else {
+		b, _ = json.MarshalIndent(st, "", "  ")
+	}
+	return writeFileAtomic(s.path, b)
+}
+
+type gobStore struct {
+	path string
+}
+
+func (s gobStore) Load() (State, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return State{}, err
+	}
+	defer f.Close()
+	var st State
+	err = gob.NewDecoder(f).Decode(&st)
+	return st, err
+}
+
+func (s gobStore) Save(st State) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(st); err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, buf.Bytes())
+}
+
+// writeFileAtomic writes b next to path and renames it into place.
+func writeFileAtomic(path string, b []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// lockState takes an exclusive lock on path+".lock", which the timer runs
+// and the bot share. Closing the file releases it.
+func lockState(path string) (unlock func(), err error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() { f.Close() }, nil
+}
+
+// saveStateLocked saves a run's state under the state lock. Subscriptions
+// belong to the bot, which may have changed them since st was loaded, so the
+// ones on disk are kept.
+func saveStateLocked(path string, st State) error {
+	unlock, err := lockState(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if cur, err := storeFor(path).Load(); err == nil {
+		st.Subscriptions = cur.Subscriptions
+		// /today marks days seen too; keep what the bot added meanwhile.
+		for chat, dates := range cur.Seen {
+			for key, hash := range dates {
+				if _, ok := st.Seen[chat][key]; !ok {
+					st = markSeenHash(st, chat, key, hash)
+				}
+			}
+		}
+	}
+	return saveStateRetry(path, st)
+}
+
+// saveStateRetry retries saveState to ride out transient disk errors, then
+// tries POWERBOT_STATE_FALLBACK so the run's state is not lost.
+func saveStateRetry(path string, st State) error {
+	var err error
+	for attempt := 1; attempt <= stateSaveAttempts; attempt++ {
+		if err = saveState(path, st); err == nil {
+			return nil
+		}
+		logKV("warn", "state save failed", "attempt", attempt, "of", stateSaveAttempts, "err", err)
+		if attempt < stateSaveAttempts {
+			time.Sleep(stateSaveDelay)
+		}
+	}
+	fb := os.Getenv(stateFallbackEnv)
+	if fb == "" {
+		return err
+	}
+	if ferr := saveState(fb, st); ferr != nil {
+		return errors.Join(err, fmt.Errorf("fallback: %w", ferr))
+	}
+	logf("warning: state saved to fallback %s", fb)
+	return nil
+}
+
+// newerFile reports whether a exists and was modified after b (or b is missing).
+func newerFile(a, b string) bool {
+	ai, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bi, err := os.Stat(b)
+	if err != nil {
+		return true
+	}
+	return ai.ModTime().After(bi.ModTime())
+}
+
+// sameKey reports whether a and b are the same schedule slot: one date in one
+// region.
+func sameKey(a, b DayInfo) bool {
+	return a.Date == b.Date && a.Region == b.Region
+}
+
+func findDay(st State, day DayInfo) *DayInfo {
+	for i := range st.Days {
+		if sameKey(st.Days[i], day) {
+			return &st.Days[i]
+		}
+	}
+	return nil
+}
+
+func upsertDay(st State, day DayInfo) State {
+	found := false
+	for i := range st.Days {
+		if sameKey(st.Days[i], day) {
+			st.Days[i] = day
+			found = true
+			break
+		}
+	}
+	if !found {
+		st.Days = append(st.Days, day)
+	}
+	return st
+}
+
+// criticalGroup is one group in the critical webhook payload.
+type criticalGroup struct {
+	Group   string `json:"group"`
+	Minutes int    `json:"minutes"`
+	Text    string `json:"text"`
+}
+
+// escalateCritical POSTs day's groups whose outage exceeds
+// POWERBOT_CRITICAL_MINUTES to POWERBOT_CRITICAL_WEBHOOK, once per day.
+func escalateCritical(ctx context.Context, st State, day DayInfo) State {
+	hook := os.Getenv(criticalWebhookEnv)
+	threshold, _ := strconv.Atoi(os.Getenv(criticalMinutesEnv))
+	if hook == "" || threshold <= 0 {
+		return st
+	}
+	if dryRun {
+		logf("dry-run: not calling the critical webhook")
+		return st
+	}
+	key := dayKey(day)
+	for _, k := range st.Escalated {
+		if k == key {
+			return st
+		}
+	}
+	var groups []criticalGroup
+	for _, g := range watched {
+		if info, ok := day.Groups[g.Name]; ok && info.Minutes > threshold {
+			groups = append(groups, criticalGroup{Group: g.Name, Minutes: info.Minutes, Text: info.Text})
+		}
+	}
+	if len(groups) == 0 {
+		return st
+	}
+	payload, _ := json.Marshal(struct {
+		Date   string          `json:"date"`
+		Region string          `json:"region,omitempty"`
+		Groups []criticalGroup `json:"groups"`
+	}{day.Date, day.Region, groups})
+	ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook, bytes.NewReader(payload))
+	if err != nil {
+		logKV("error", "critical webhook failed", "err", err)
+		return st
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		logKV("error", "critical webhook failed", "err", err)
+		return st
+	}
+	drainClose(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		logf("critical webhook status %d", resp.StatusCode)
+		return st
+	}
+	logf("escalated %s to critical webhook", day.Date)
+	st.Escalated = append(st.Escalated, key)
+	return st
+}
+
+// warnUnrecognized tells the debug chat, once per day, that a schedule was
+// published but none of our groups could be found in it.
+func warnUnrecognized(ctx context.Context, st State, u unrecognizedDay, alerts Notifier) State {
+	if alerts == nil {
+		return st
+	}
+	key := dayKey(DayInfo{Date: u.Date, Region: u.Region})
+	for _, k := range st.Warned {
+		if k == key {
+			return st
+		}
+	}
+	present := "жодної"
+	if len(u.Present) > 0 {
+		present = strings.Join(u.Present, ", ")
+	}
+	msg := fmt.Sprintf("⚠️ знайдено графік на %s, але групи не розпізнано\nу графіку: %s", escapeMarkdownV2(schedule.ToDM(u.Date)), escapeMarkdownV2(present))
+	if err := alerts.Notify(ctx, DayInfo{Date: u.Date}, msg); err != nil {
+		logKV("error", "debug chat post failed", "err", err)
+		return st
+	}
+	st.Warned = append(st.Warned, key)
+	return st
+}
+
+// dayHash identifies a day's schedule content for per-chat seen tracking.
+func dayHash(day DayInfo) string {
+	keys := make([]string, 0, len(day.Groups))
+	for k := range day.Groups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	h := sha256.New()
+	for _, k := range keys {
+		fmt.Fprintf(h, "%s=%s\n", k, day.Groups[k].Text)
+	}
+	for _, img := range day.Images {
+		fmt.Fprintf(h, "img=%s\n", img)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// markSeen records that chatID has seen the current schedule for day.
+func markSeen(st State, chatID string, day DayInfo) State {
+	return markSeenHash(st, chatID, dayKey(day), dayHash(day))
+}
+
+func markSeenHash(st State, chatID, key, hash string) State {
+	if st.Seen == nil {
+		st.Seen = map[string]map[string]string{}
+	}
+	if st.Seen[chatID] == nil {
+		st.Seen[chatID] = map[string]string{}
+	}
+	st.Seen[chatID][key] = hash
+	return st
+}
+
+// needsUpdate reports whether chatID hasn't seen the current schedule for
+// day, either because it saw an older one or none at all.
+func needsUpdate(st State, chatID string, day DayInfo) bool {
+	return st.Seen[chatID][dayKey(day)] != dayHash(day)
+}
+
+// unseen drops the Telegram chats that already have the current schedule of
+// every one of days (e.g. from /today, or a post that reached them before
+// another chat failed) when per-chat tracking is enabled.
+func unseen(st State, notifiers []Notifier, days ...DayInfo) []Notifier {
+	if os.Getenv(trackSeenEnv) == "" {
+		return notifiers
+	}
+	var out []Notifier
+	for _, n := range notifiers {
+		if t, ok := n.(telegramNotifier); ok && !slices.ContainsFunc(days, func(d DayInfo) bool { return needsUpdate(st, t.chatID, d) }) {
+			logf("chat %s already has the schedule for %s, skipping", t.chatID, days[0].Date)
+			continue
+		}
+		out = append(out, n)
+	}
+	return out
+}
+
+// markPushed records chats as having seen day when per-chat tracking is
+// enabled.
+func markPushed(st State, day DayInfo, chats []string) State {
+	if os.Getenv(trackSeenEnv) == "" {
+		return st
+	}
+	for _, chatID := range chats {
+		st = markSeen(st, chatID, day)
+	}
+	return st
+}
+
+// dayKey identifies a day in State.Posted.
+func dayKey(day DayInfo) string {
+	if day.Region == "" {
+		return day.Date
+	}
+	return day.Date + "/" + day.Region
+}
+
+// alreadyPosted reports whether this exact schedule was the last one posted.
+func alreadyPosted(st State, day DayInfo) bool {
+	h, ok := st.Posted[dayKey(day)]
+	return ok && h == dayHash(day)
+}
+
+func markPosted(st State, day DayInfo) State {
+	if st.Posted == nil {
+		st.Posted = map[string]string{}
+	}
+	st.Posted[dayKey(day)] = dayHash(day)
+	return st
+}
+
+// keepWindow drops state for dates outside refs and the day before each, so
+// the checked window (see checkDates) plus yesterday is retained.
+func keepWindow(st State, refs []time.Time) State {
+	cutoff := map[string]bool{}
+	for _, d := range refs {
+		cutoff[d.Format("2006-01-02")] = true
+		cutoff[d.AddDate(0, 0, -1).Format("2006-01-02")] = true
+	}
+	var kept []DayInfo
+	for _, d := range st.Days {
+		if cutoff[d.Date] {
+			kept = append(kept, d)
+		}
+	}
+	st.Days = kept
+	var warned []string
+	for _, k := range st.Warned {
+		if cutoff[strings.SplitN(k, "/", 2)[0]] {
+			warned = append(warned, k)
+		}
+	}
+	st.Warned = warned
+	var escalated []string
+	for _, k := range st.Escalated {
+		if cutoff[strings.SplitN(k, "/", 2)[0]] {
+			escalated = append(escalated, k)
+		}
+	}
+	st.Escalated = escalated
+	for key := range st.Updates {
+		if !cutoff[strings.SplitN(key, "/", 2)[0]] {
+			delete(st.Updates, key)
+		}
+	}
+	for key := range st.Posted {
+		if !cutoff[strings.SplitN(key, "/", 2)[0]] {
+			delete(st.Posted, key)
+		}
+	}
+	for key := range st.Messages {
+		if !cutoff[strings.SplitN(key, "/", 2)[0]] {
+			delete(st.Messages, key)
+		}
+	}
+	for chat, keys := range st.Seen {
+		for key := range keys {
+			if !cutoff[strings.SplitN(key, "/", 2)[0]] {
+				delete(keys, key)
+			}
+		}
+		if len(keys) == 0 {
+			delete(st.Seen, chat)
+		}
+	}
+	return st
+}
+
+// compareDay reports whether cur differs from old, by how many minutes the
+// worst-hit group's outage grew (0 if none grew past the tolerance) and which
+// groups went from an outage to available (cleared). With
+// POWERBOT_ADDED_GROUP_NEUTRAL a group missing from old is new information,
+// not a worsening, and worse is -1 when such additions are the only change.
+func compareDay(old, cur DayInfo) (changed bool, worse int, cleared []string) {
+	// Parsing variations can shift totals by a minute or two; only a larger
+	// increase counts as worse.
+	tolerance := 0
+	if v := os.Getenv(minutesToleranceEnv); v != "" {
+		if n, err := strconv.Atoi(v); err != nil || n < 0 {
+			logf("warning: invalid %s %q, using 0", minutesToleranceEnv, v)
+		} else {
+			tolerance = n
+		}
+	}
+	// With zeroOnly, only a group gaining its first outage or losing its
+	// last one is a change; interval tweaks are left unposted.
+	zeroOnly := os.Getenv(zeroTransitionsEnv) != ""
+	addedNeutral := os.Getenv(addedNeutralEnv) != ""
+	onlyAdded := false
+	for _, spec := range watched {
+		g := spec.Name
+		o, okO := old.Groups[g]
+		n, okN := cur.Groups[g]
+		if !okN && !okO {
+			continue
+		}
+		if addedNeutral && !okO {
+			onlyAdded = !changed || onlyAdded
+			changed = true
+			continue
+		}
+		if okO && okN && o.Text != schedule.AvailableText && n.Text == schedule.AvailableText {
+			cleared = append(cleared, g)
+		}
+		if zeroOnly {
+			if (o.Minutes > 0) != (n.Minutes > 0) {
+				worse = max(worse, n.Minutes-o.Minutes)
+				changed, onlyAdded = true, false
+			}
+			continue
+		}
+		if !okO || !okN || !schedule.SameSchedule(o.Text, n.Text) {
+			if n.Minutes > o.Minutes+tolerance {
+				worse = max(worse, n.Minutes-o.Minutes)
+			}
+			changed, onlyAdded = true, false
+		}
+	}
+	if !slices.Equal(old.Images, cur.Images) {
+		changed, onlyAdded = true, false
+	}
+	if onlyAdded {
+		worse = -1
+	}
+	return
+}
+
+func postSchedule(ctx context.Context, notifiers []Notifier, day DayInfo, isUpdate bool, worse int, cleared []string) (chats []string, err error) {
+	return postRun(ctx, notifiers, []DayInfo{day}, isUpdate, worse, cleared)
+}
+
+// postRun posts a run of days with the same schedule as one message under a
+// date range header; notifiers see it as a post for the first day. It
+// returns the Telegram chats it reached.
+func postRun(ctx context.Context, notifiers []Notifier, run []DayInfo, isUpdate bool, worse int, cleared []string) (chats []string, err error) {
+	msg := formatRun(run, isUpdate, worse, cleared, watched)
+	var errs []error
+	for _, n := range notifiers {
+		nmsg := msg
+		if f, ok := n.(groupFilter); ok && f.onlyGroups() != nil {
+			nmsg = formatRun(run, isUpdate, worse, cleared, f.onlyGroups())
+		}
+		if err := deliver(ctx, n, run[0], nmsg); err != nil {
+			errs = append(errs, err)
+		} else if t, ok := n.(telegramNotifier); ok {
+			chats = append(chats, t.chatID)
+		}
+	}
+	return chats, errors.Join(errs...)
+}
+
+// deliver sends one notifier's post, logging the outcome per Telegram chat
+// so a chat that blocks the bot is visible without stopping the others.
+func deliver(ctx context.Context, n Notifier, day DayInfo, msg string) error {
+	err := n.Notify(ctx, day, msg)
+	if t, ok := n.(telegramNotifier); ok {
+		if err != nil {
+			logKV("error", "post failed", "chat", t.chatID, "err", err)
+			err = fmt.Errorf("chat %s: %w", t.chatID, err)
+		} else if os.Getenv(debugEnv) != "" || len(chatIDs()) > 1 {
+			logKV("info", "posted", "chat", t.chatID)
+		}
+	}
+	return err
+}
+
+func formatSchedule(day DayInfo, isUpdate bool, worse int, cleared []string, groups []groupSpec) string {
+	return formatRun([]DayInfo{day}, isUpdate, worse, cleared, groups)
+}
+
+// formatRun is formatSchedule for a run of days with the same schedule,
+// titled with their date range and carrying each day's note.
+func formatRun(run []DayInfo, isUpdate bool, worse int, cleared []string, groups []groupSpec) string {
+	day, dm := run[0], rangeDM(run)
+	msg := scheduleText(day, dm, isUpdate, worse, cleared, groups)
+	if t, err := time.Parse(time.RFC3339, day.Updated); err == nil {
+		loc := kyivLocation()
+		msg += "\nоновлено: " + escapeMarkdownV2(t.In(loc).Format("02.01 15:04"))
+	}
+	var notes []string
+	for _, d := range run {
+		if note := dayNote(d.Date); note != "" && !slices.Contains(notes, note) {
+			notes = append(notes, note)
+			msg += "\n" + escapeMarkdownV2(note)
+		}
+	}
+	if link := dayLink(os.Getenv(sourceAnchorEnv), day.Date); link != "" {
+		msg += fmt.Sprintf("\n[відкрити графік на %s](%s)", escapeMarkdownV2(dm), escapeLinkV2(link))
+	}
+	return msg
+}
+
+// dayNote returns the operator's note for date from POWERBOT_NOTES_FILE, a
+// JSON object of "YYYY-MM-DD": "text". Notes only decorate posts; they are not
+// part of the stored schedule, so editing one never triggers an update.
+func dayNote(date string) string {
+	path := os.Getenv(notesFileEnv)
+	if path == "" {
+		return ""
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		logf("warning: notes file: %v", err)
+		return ""
+	}
+	var notes map[string]string
+	if err := json.Unmarshal(b, &notes); err != nil {
+		logf("warning: notes file %s: %v", path, err)
+		return ""
+	}
+	return strings.TrimSpace(notes[date])
+}
+
+// dayLink fills the {date} (YYYY-MM-DD) and {dm} (DD.MM) tokens of tmpl. A
+// template without tokens is used as-is, i.e. a plain link to the source.
+func dayLink(tmpl, date string) string {
+	return strings.NewReplacer("{date}", date, "{dm}", schedule.ToDM(date)).Replace(strings.TrimSpace(tmpl))
+}
+
+func scheduleText(day DayInfo, dm string, isUpdate bool, worse int, cleared []string, groups []groupSpec) string {
+	// Cleared groups get their own line, or with POWERBOT_CELEBRATE_AVAILABLE
+	// the whole title.
+	celebrate := os.Getenv(celebrateEnv) != ""
+	var restored []string
+	for _, g := range groups {
+		if slices.Contains(cleared, g.Name) {
+			restored = append(restored, fmt.Sprintf("🎉 %s %s: відключення скасовано", g.Emoji, escapeMarkdownV2(groupNumber(g.Name))))
+		}
+	}
+	cleared = celebrated(cleared, groups)
+	if messageTmpl != nil {
+		var b strings.Builder
+		err := messageTmpl.Execute(&b, newMessageData(day, dm, isUpdate, worse, cleared, groups))
+		if err == nil {
+			return strings.TrimSpace(b.String())
+		}
+		logf("warning: message template: %v, using the built-in format", err)
+	}
+	if !celebrate {
+		cleared = nil
+	}
+	if os.Getenv(compactEnv) != "" {
+		return compactLine(day, dm, isUpdate, worse, cleared, groups)
+	}
+	dm = escapeMarkdownV2(dm)
+	title := fmt.Sprintf("графік на %s", dm)
+	if isUpdate {
+		title = fmt.Sprintf("upd\\. %s на %s", updateEmoji(worse), dm)
+		if len(cleared) > 0 {
+			title = fmt.Sprintf("🎉 upd\\. на %s: %s буде\\!", dm, escapeMarkdownV2(strings.Join(cleared, ", ")))
+		}
+	}
+	if day.Region != "" && day.Region != os.Getenv(regionEnv) {
+		title += " \\(" + escapeMarkdownV2(day.Region) + "\\)"
+	}
+	if len(day.Groups) == 0 && len(day.Images) > 0 {
+		return fmt.Sprintf("*%s*\nграфік опубліковано зображенням", title)
+	}
+	if os.Getenv(combineSameEnv) != "" {
+		groups = combineSame(day, groups)
+	}
+	var lines []string
+	lines = append(lines, fmt.Sprintf("*%s*", title))
+	for _, g := range groups {
+		lines = append(lines, formatLine(day, g.Name, g.Label, maxIntervals))
+	}
+	if isUpdate && !celebrate {
+		lines = append(lines, restored...)
+	}
+	return strings.Join(dedupeLines(lines), "\n")
+}
+
+// messageData is what POWERBOT_MESSAGE_TEMPLATE renders: the day itself
+// (.Date, .Region, .Groups) plus the post's context.
+type messageData struct {
+	DayInfo
+	DM      string // date as DD.MM, or the range of a combined post
+	Update  bool
+	Emoji   string // update grade from updateEmoji, empty for a new post
+	Cleared []string
+	Lines   []messageLine // the groups to show, in order
+}
+
+type messageLine struct {
+	Name, Label, Emoji string
+	Text               string // notFoundText() when the group is missing
+	Minutes            int
+	Queue              int // 0 when the page gives none
+	Found              bool
+}
+
+// loadMessageTemplate parses POWERBOT_MESSAGE_TEMPLATE_FILE or else
+// POWERBOT_MESSAGE_TEMPLATE and test-renders it, so a broken template stops
+// the bot at startup rather than on the first post. Nil means built-in.
+func loadMessageTemplate() (*template.Template, error) {
+	src := os.Getenv(messageTemplateEnv)
+	if path := os.Getenv(messageTemplateFileEnv); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		src = string(b)
+	}
+	if strings.TrimSpace(src) == "" {
+		return nil, nil
+	}
+	t, err := template.New("message").Option("missingkey=error").Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	sample := DayInfo{Date: "2025-12-12", Groups: map[string]GroupInfo{}}
+	for _, g := range watched {
+		sample.Groups[g.Name] = GroupInfo{Text: "Електроенергії немає з 08:00 до 12:00", Minutes: 240}
+	}
+	if err := t.Execute(io.Discard, newMessageData(sample, "12.12", true, 30, nil, watched)); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// newMessageData fills the template data with every text already escaped for
+// MarkdownV2, so a template only has to get its own literal text right.
+func newMessageData(day DayInfo, dm string, isUpdate bool, worse int, cleared []string, groups []groupSpec) messageData {
+	esc := day
+	esc.Date, esc.Region = escapeMarkdownV2(day.Date), escapeMarkdownV2(day.Region)
+	esc.Groups = make(map[string]GroupInfo, len(day.Groups))
+	for name, g := range day.Groups {
+		g.Text = escapeMarkdownV2(g.Text)
+		esc.Groups[name] = g
+	}
+	data := messageData{DayInfo: esc, DM: escapeMarkdownV2(dm), Update: isUpdate}
+	for _, c := range cleared {
+		data.Cleared = append(data.Cleared, escapeMarkdownV2(c))
+	}
+	if isUpdate {
+		data.Emoji = updateEmoji(worse)
+	}
+	for _, g := range groups {
+		info, ok := day.Groups[g.Name]
+		line := messageLine{Name: escapeMarkdownV2(g.Name), Label: g.Label, Emoji: g.Emoji, Text: escapeMarkdownV2(info.Text), Minutes: info.Minutes, Queue: info.Queue, Found: ok}
+		if !ok {
+			line.Text = escapeMarkdownV2(notFoundText())
+		}
+		data.Lines = append(data.Lines, line)
+	}
+	return data
+}
+
+// celebrated renders the cleared groups that are among groups as numbers.
+func celebrated(cleared []string, groups []groupSpec) []string {
+	var out []string
+	for _, name := range cleared {
+		for _, g := range groups {
+			if g.Name == name {
+				out = append(out, groupNumber(name))
+			}
+		}
+	}
+	return out
+}
+
+// combineSame folds the water group into the power line, relabelled as both,
+// when the two have the same outage windows.
+func combineSame(day DayInfo, groups []groupSpec) []groupSpec {
+	power, okP := day.Groups[groupPower]
+	water, okW := day.Groups[groupWater]
+	if !okP || !okW || !schedule.SameSchedule(power.Text, water.Text) {
+		return groups
+	}
+	pi, wi := -1, -1
+	for i, g := range groups {
+		switch g.Name {
+		case groupPower:
+			pi = i
+		case groupWater:
+			wi = i
+		}
+	}
+	if pi < 0 || wi < 0 {
+		return groups
+	}
+	out := make([]groupSpec, 0, len(groups)-1)
+	for i, g := range groups {
+		if i == wi {
+			continue
+		}
+		if i == pi {
+			g.Label = labelBoth
+		}
+		out = append(out, g)
+	}
+	return out
+}
+
+// dedupeLines drops repeated lines, keeping the first occurrence of each.
+func dedupeLines(lines []string) []string {
+	seen := map[string]bool{}
+	out := lines[:0]
+	for _, l := range lines {
+		if !seen[l] {
+			seen[l] = true
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+// notFoundText is shown for a watched group missing from a day's schedule.
+func notFoundText() string {
+	if v := os.Getenv(notFoundEnv); v != "" {
+		return v
+	}
+	return defaultNotFound
+}
+
+// loadMaxIntervals parses POWERBOT_MAX_INTERVALS, warning once and falling
+// back to 0 (show all) when it is not a positive number.
+func loadMaxIntervals() int {
+	v := os.Getenv(maxIntervalsEnv)
+	if v == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		logf("warning: invalid %s %q, showing all intervals", maxIntervalsEnv, v)
+		return 0
+	}
+	return n
+}
+
+// formatLine renders one group of a day; limit caps the listed outage
+// windows, 0 meaning no cap.
+func formatLine(day DayInfo, group, label string, limit int) string {
+	if g, ok := day.Groups[group]; ok {
+		if g.Queue > 0 {
+			label += fmt.Sprintf(" \\(черга %d\\)", g.Queue)
+		}
+		text := escapeMarkdownV2(g.Text)
+		if limit > 0 {
+			if cut, hidden := schedule.TruncateIntervals(g.Text, limit); hidden > 0 {
+				text = fmt.Sprintf("%s \\(\\+%d ще\\)", escapeMarkdownV2(cut), hidden)
+			}
+		}
+		line := fmt.Sprintf("%s: %s", label, text)
+		if os.Getenv(showLongestEnv) != "" {
+			if longest := schedule.LongestOutage(g.Text); longest > 0 {
+				line += fmt.Sprintf(" \\(найдовше: %s\\)", schedule.FormatDuration(longest))
+			}
+		}
+		return line
+	}
+	return fmt.Sprintf("%s: %s", label, escapeMarkdownV2(notFoundText()))
+}
+
+// relativeTime phrases a duration from now, e.g. "через 2 год 15 хв".
+func relativeTime(d time.Duration) string {
+	mins := int(d.Round(time.Minute).Minutes())
+	if mins <= 0 {
+		return "зараз"
+	}
+	return "через " + schedule.FormatDuration(mins)
+}
+
+// compactLine renders a whole day as a single line of total outage hours,
+// e.g. "12.12: 💡6ч 💧0ч".
+func compactLine(day DayInfo, dm string, isUpdate bool, worse int, cleared []string, groups []groupSpec) string {
+	parts := []string{escapeMarkdownV2(dm) + ":"}
+	for _, g := range groups {
+		parts = append(parts, compactGroup(day, g.Name, g.Emoji))
+	}
+	line := strings.Join(dedupeLines(parts), " ")
+	if isUpdate {
+		if len(cleared) > 0 {
+			return "🎉 upd\\. " + line
+		}
+		return "upd\\. " + updateEmoji(worse) + " " + line
+	}
+	return line
+}
+
+// updateEmoji grades an update by how many minutes of outage it added: 🍾
+// for none, 😕 below POWERBOT_SEVERE_MINUTES, 😩 from there on, and 🆕 when
+// the update only lists newly published groups (worse < 0).
+func updateEmoji(worse int) string {
+	severe := defaultSevereMinutes
+	if v := os.Getenv(severeMinutesEnv); v != "" {
+		if n, err := strconv.Atoi(v); err != nil || n < 0 {
+			logf("warning: invalid %s %q, using %d", severeMinutesEnv, v, defaultSevereMinutes)
+		} else {
+			severe = n
+		}
+	}
+	switch {
+	case worse < 0:
+		return "🆕"
+	case worse == 0:
+		return "🍾"
+	case worse < severe:
+		return "😕"
+	}
+	return "😩"
+}
+
+func compactGroup(day DayInfo, group, emoji string) string {
+	g, ok := day.Groups[group]
+	if !ok {
+		return emoji + escapeMarkdownV2(notFoundText())
+	}
+	hours := math.Round(float64(g.Minutes)/6) / 10
+	return emoji + escapeMarkdownV2(strconv.FormatFloat(hours, 'f', -1, 64)) + "ч"
+}
+
+// Notifier delivers a formatted schedule message to one destination.
+type Notifier interface {
+	Notify(ctx context.Context, day DayInfo, msg string) error
+}
+
+// chatUsernameRe matches a public chat's @username as Telegram allows it:
+// 5 to 32 characters, starting with a letter.
+var chatUsernameRe = regexp.MustCompile(`^@[A-Za-z][A-Za-z0-9_]{4,31}$`)
+
+// normalizeChatID trims v and checks it is a numeric chat id (negative for
+// groups, -100… for supergroups and channels) or a public @username.
+func normalizeChatID(v string) (string, error) {
+	v = strings.TrimSpace(v)
+	if strings.HasPrefix(v, "@") {
+		if !chatUsernameRe.MatchString(v) {
+			return "", fmt.Errorf("%q is not a valid @username", v)
+		}
+		return v, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n == 0 {
+		return "", fmt.Errorf("%q is neither a numeric chat id nor an @username", v)
+	}
+	return strconv.FormatInt(n, 10), nil
+}
+
+// chatIDs returns the broadcast chats in POWERBOT_CHAT_ID, a comma-separated
+// list; the first is the primary chat for the countdown pin and the queue.
+func chatIDs() []string {
+	var ids []string
+	for _, id := range strings.Split(os.Getenv(chatIDEnv), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// loadNotifiers builds the configured destinations from the environment.
+func loadNotifiers() []Notifier {
+	var out []Notifier
+	chats := chatIDs()
+	for _, chatID := range chats {
+		if t, ok := newTelegramNotifier(chatID); ok {
+			out = append(out, t)
+		}
+	}
+	chatID := ""
+	if len(chats) > 0 {
+		chatID = chats[0]
+	}
+	if v := os.Getenv(queueURLEnv); v != "" {
+		u, err := url.Parse(v)
+		if err != nil || (u.Scheme != "nats" && u.Scheme != "redis") || strings.Trim(u.Path, "/") == "" {
+			logf("warning: invalid %s %q (want nats://host:port/subject or redis://host:port/key), skipping queue", queueURLEnv, v)
+		} else {
+			out = append(out, queueNotifier{u: u, chatID: chatID})
+		}
+	}
+	if gh := os.Getenv(githubTokenEnv); gh != "" {
+		repo := os.Getenv(githubRepoEnv)
+		path := os.Getenv(githubPathEnv)
+		if path == "" {
+			path = defaultGithubPath
+		}
+		api := os.Getenv(githubAPIEnv)
+		if api == "" {
+			api = defaultGithubAPI
+		}
+		if strings.Count(repo, "/") != 1 {
+			logf("warning: %s must be owner/repo, skipping GitHub archive", githubRepoEnv)
+		} else {
+			out = append(out, githubNotifier{api: strings.TrimSuffix(api, "/"), token: gh, repo: repo, path: strings.TrimPrefix(path, "/")})
+		}
+	}
+	if host := os.Getenv(smtpHostEnv); host != "" {
+		port := os.Getenv(smtpPortEnv)
+		if port == "" {
+			port = defaultSMTPPort
+		}
+		var to []string
+		for _, addr := range strings.Split(os.Getenv(smtpToEnv), ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				to = append(to, addr)
+			}
+		}
+		if len(to) == 0 || os.Getenv(smtpFromEnv) == "" {
+			logf("warning: POWERBOT_SMTP_FROM or POWERBOT_SMTP_TO not set, skipping email")
+		} else {
+			out = append(out, smtpNotifier{
+				addr: host + ":" + port,
+				host: host,
+				user: os.Getenv(smtpUserEnv),
+				pass: os.Getenv(smtpPassEnv),
+				from: os.Getenv(smtpFromEnv),
+				to:   to,
+			})
+		}
+	}
+	return out
+}
+
+// loadAdminNotifier returns POWERBOT_ADMIN_CHAT_ID, or else the debug chat,
+// for the parse health alert; nil if neither is set.
+func loadAdminNotifier() Notifier {
+	chatID := os.Getenv(adminChatEnv)
+	if chatID == "" {
+		return loadDebugNotifier()
+	}
+	if t, ok := newTelegramNotifier(chatID); ok {
+		return t
 	}
 	return nil
 }
 
-func urlEncode(s string) string {
+// checkParseHealth records when a schedule was last parsed (parsed being
+// this cycle's days) and, once none has been for POWERBOT_PARSE_ALERT_DAYS,
+// tells admin once that parsing may be broken (e.g. LOE changed the page).
+// The flag clears when parsing recovers.
+func checkParseHealth(ctx context.Context, st State, parsed []DayInfo, now time.Time, admin Notifier) State {
+	if len(parsed) > 0 || st.LastParsed == "" {
+		if st.ParseAlerted {
+			logf("schedules parse again, clearing the parse alert")
+		}
+		st.LastParsed, st.ParseAlerted = now.Format(time.RFC3339), false
+		return st
+	}
+	days := defaultParseAlertDays
+	if v := os.Getenv(parseAlertDaysEnv); v != "" {
+		if n, err := strconv.Atoi(v); err != nil || n < 1 {
+			logf("warning: invalid %s %q, using %d", parseAlertDaysEnv, v, defaultParseAlertDays)
+		} else {
+			days = n
+		}
+	}
+	last, err := time.Parse(time.RFC3339, st.LastParsed)
+	if err != nil || st.ParseAlerted || now.Sub(last) < time.Duration(days)*24*time.Hour {
+		return st
+	}
+	logf("warning: no schedule parsed since %s, parsing may be broken", last.Format(time.RFC3339))
+	if admin == nil {
+		return st
+	}
+	loc := kyivLocation()
+	msg := fmt.Sprintf("⚠️ жодного графіка не розпізнано з %s, можливо, змінилась сторінка LOE", escapeMarkdownV2(last.In(loc).Format("02.01 15:04")))
+	if err := admin.Notify(ctx, DayInfo{Date: startOfDay(now).Format("2006-01-02")}, msg); err != nil {
+		logKV("error", "admin chat post failed", "err", err)
+		return st
+	}
+	st.ParseAlerted = true
+	return st
+}
+
+// loadDebugNotifier returns the operator chat for warnings, or nil.
+func loadDebugNotifier() Notifier {
+	chatID := os.Getenv(debugChatEnv)
+	t, ok := newTelegramNotifier(chatID)
+	if !ok || chatID == "" {
+		return nil
+	}
+	return t
+}
+
+// newTelegramNotifier targets chatID with its own bot token and topic from
+// POWERBOT_CHAT_TOKENS, or the global POWERBOT_TOKEN. ok is false when there
+// is no token to send with.
+func newTelegramNotifier(chatID string) (telegramNotifier, bool) {
+	t := telegramNotifier{token: os.Getenv(tokenEnv), chatID: chatID}
+	if r, ok := chatRoutes()[chatID]; ok {
+		if r.token != "" {
+			t.token = r.token
+		}
+		t.thread = r.thread
+	}
+	return t, t.token != ""
+}
+
+type chatRoute struct {
+	token, thread string
+}
+
+// chatRoutes parses POWERBOT_CHAT_TOKENS: comma-separated chatID=token entries,
+// each optionally followed by /threadID to post into a forum topic.
+func chatRoutes() map[string]chatRoute {
+	routes := map[string]chatRoute{}
+	for _, entry := range strings.Split(os.Getenv(chatTokensEnv), ",") {
+		chat, rest, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			if entry != "" {
+				logf("warning: bad %s entry %q, want chatID=token[/thread]", chatTokensEnv, entry)
+			}
+			continue
+		}
+		token, thread, _ := strings.Cut(strings.TrimSpace(rest), "/")
+		routes[strings.TrimSpace(chat)] = chatRoute{token: token, thread: thread}
+	}
+	return routes
+}
+
+// groupFilter is implemented by notifiers that only want some groups, such
+// as a chat subscribed via /subscribe.
+type groupFilter interface {
+	onlyGroups() []groupSpec
+}
+
+type telegramNotifier struct {
+	token  string
+	chatID string
+	thread string      // forum topic id, optional
+	only   []groupSpec // nil means every watched group
+	// sent is State.Messages when posts are threaded: each text post replies
+	// to the previous day's post and records its own id. Nil disables it.
+	sent map[string]int
+}
+
+func (t telegramNotifier) onlyGroups() []groupSpec { return t.only }
+
+func (t telegramNotifier) Notify(ctx context.Context, day DayInfo, msg string) error {
+	if len(day.Groups) == 0 && len(day.Images) > 0 {
+		sent, err := t.sendImages(ctx, day, msg)
+		if err == nil {
+			return nil
+		}
+		// Once a picture is out, the text would repeat it; report the rest.
+		if sent > 0 {
+			return fmt.Errorf("schedule image %d of %d: %w", sent+1, len(day.Images), err)
+		}
+		logKV("warn", "schedule image post failed, falling back to text", "err", err)
+	} else if os.Getenv(imageEnv) != "" {
+		groups := watched
+		if t.only != nil {
+			groups = t.only
+		}
+		img, err := renderDayPNG(day, groups)
+		if err == nil {
+			err = sendPhoto(ctx, t.token, t.chatID, t.thread, img, "schedule.png", msg)
+		}
+		if err == nil {
+			return nil
+		}
+		logKV("warn", "photo post failed, falling back to text", "err", err)
+	}
+	if t.sent == nil {
+		return sendTelegram(ctx, t.token, t.chatID, t.thread, msg)
+	}
+	replyTo := 0
+	if d, err := time.Parse("2006-01-02", day.Date); err == nil {
+		prev := DayInfo{Date: d.AddDate(0, 0, -1).Format("2006-01-02"), Region: day.Region}
+		replyTo = t.sent[dayKey(prev)+"/"+t.chatID]
+	}
+	id, err := sendTelegramReply(ctx, t.token, t.chatID, t.thread, msg, replyTo)
+	if err == nil && id != 0 {
+		t.sent[dayKey(day)+"/"+t.chatID] = id
+	}
+	return err
+}
+
+// sendImages reposts the pictures of a day LOE published as images, the
+// first one captioned with msg's title line, and returns how many went out.
+func (t telegramNotifier) sendImages(ctx context.Context, day DayInfo, msg string) (int, error) {
+	caption, _, _ := strings.Cut(msg, "\n")
+	for i, src := range day.Images {
+		img, name, err := downloadImage(ctx, src)
+		if err != nil {
+			return i, err
+		}
+		if i > 0 {
+			caption = ""
+		}
+		if err := sendPhoto(ctx, t.token, t.chatID, t.thread, img, name, caption); err != nil {
+			return i, err
+		}
+	}
+	return len(day.Images), nil
+}
+
+// downloadImage fetches a schedule image, resolving src against the LOE page
+// the rawHtml is shown on, and returns it with a file name for the upload.
+func downloadImage(ctx context.Context, src string) ([]byte, string, error) {
+	base, err := url.Parse(pageURL)
+	if err != nil {
+		return nil, "", err
+	}
+	u, err := base.Parse(src)
+	if err != nil {
+		return nil, "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer drainClose(resp.Body)
+	if resp.StatusCode != 200 {
+		return nil, "", fmt.Errorf("image %s: status %d", u, resp.StatusCode)
+	}
+	// Telegram takes photos up to 10 MB.
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 10<<20))
+	if err != nil {
+		return nil, "", err
+	}
+	name := path.Base(u.Path)
+	if name == "/" || name == "." {
+		name = "schedule.png"
+	}
+	return b, name, nil
+}
+
+// threadReplies makes the Telegram notifiers among ns reply to the previous
+// day's post, tracking message ids in ids.
+func threadReplies(ns []Notifier, ids map[string]int) []Notifier {
+	out := make([]Notifier, len(ns))
+	for i, n := range ns {
+		if t, ok := n.(telegramNotifier); ok {
+			t.sent = ids
+			n = t
+		}
+		out[i] = n
+	}
+	return out
+}
+
+type smtpNotifier struct {
+	addr string
+	host string
+	user string
+	pass string
+	from string
+	to   []string
+}
+
+func (s smtpNotifier) Notify(ctx context.Context, day DayInfo, msg string) error {
+	// net/smtp has no context support; at least don't start past the deadline.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if s.user != "" {
+		auth = smtp.PlainAuth("", s.user, s.pass, s.host)
+	}
+	subject := fmt.Sprintf("Графік на %s", schedule.ToDM(day.Date))
 	var buf bytes.Buffer
-	for i := 0; i < len(s); i++ {
-		c := s[i]
-		if ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') || c == '-' || c == '_' || c == '.' || c == '~' || c == '*' || c == '(' || c == ')' || c == '\'' {
-			buf.WriteByte(c)
-		} else if c == ' ' {
-			buf.WriteByte('+')
+	fmt.Fprintf(&buf, "From: %s\r\n", s.from)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(s.to, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	buf.WriteString(strings.ReplaceAll(plainText(msg), "\n", "\r\n"))
+	if err := smtp.SendMail(s.addr, auth, s.from, s.to, buf.Bytes()); err != nil {
+		return fmt.Errorf("smtp: %w", err)
+	}
+	return nil
+}
+
+// queueNotifier hands posts to a message bus for a separate delivery worker:
+// nats://host:4222/subject publishes to a NATS subject, redis://host:6379/key
+// RPUSHes onto a Redis list. Credentials may be given as user:pass@.
+type queueNotifier struct {
+	u      *url.URL
+	chatID string
+}
+
+type queueMessage struct {
+	Chat   string               `json:"chat,omitempty"`
+	Text   string               `json:"text"`
+	Date   string               `json:"date"`
+	Region string               `json:"region,omitempty"`
+	Groups map[string]GroupInfo `json:"groups"`
+}
+
+func (q queueNotifier) Notify(ctx context.Context, day DayInfo, msg string) error {
+	payload, err := json.Marshal(queueMessage{Chat: q.chatID, Text: msg, Date: day.Date, Region: day.Region, Groups: day.Groups})
+	if err != nil {
+		return err
+	}
+	d := net.Dialer{Timeout: queueTimeout}
+	conn, err := d.DialContext(ctx, "tcp", q.u.Host)
+	if err != nil {
+		return fmt.Errorf("queue: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(queueTimeout))
+	key := strings.TrimPrefix(q.u.Path, "/")
+	switch q.u.Scheme {
+	case "nats":
+		err = natsPublish(conn, q.u.User, key, payload)
+	case "redis":
+		err = redisPush(conn, q.u.User, key, payload)
+	default:
+		err = fmt.Errorf("unsupported scheme %q", q.u.Scheme)
+	}
+	if err != nil {
+		return fmt.Errorf("queue: %w", err)
+	}
+	return nil
+}
+
+// natsPublish speaks just enough of the NATS text protocol to publish one
+// message; the trailing PING makes the server confirm it got the PUB.
+func natsPublish(conn net.Conn, user *url.Userinfo, subject string, payload []byte) error {
+	r := bufio.NewReader(conn)
+	if line, err := r.ReadString('\n'); err != nil {
+		return err
+	} else if !strings.HasPrefix(line, "INFO") {
+		return fmt.Errorf("unexpected greeting %q", strings.TrimSpace(line))
+	}
+	opts := map[string]any{"verbose": false, "pedantic": false, "name": "powerbot"}
+	if user != nil {
+		opts["user"] = user.Username()
+		opts["pass"], _ = user.Password()
+	}
+	connect, _ := json.Marshal(opts)
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\nPUB %s %d\r\n%s\r\nPING\r\n", connect, subject, len(payload), payload); err != nil {
+		return err
+	}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		switch line = strings.TrimSpace(line); {
+		case line == "PONG":
+			return nil
+		case strings.HasPrefix(line, "-ERR"):
+			return errors.New(line)
+		}
+	}
+}
+
+// redisPush sends RPUSH key payload (after AUTH if the URL has credentials).
+func redisPush(conn net.Conn, user *url.Userinfo, key string, payload []byte) error {
+	r := bufio.NewReader(conn)
+	cmd := func(args ...string) error {
+		var b bytes.Buffer
+		fmt.Fprintf(&b, "*%d\r\n", len(args))
+		for _, a := range args {
+			fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+		}
+		if _, err := conn.Write(b.Bytes()); err != nil {
+			return err
+		}
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(line, "-") {
+			return errors.New(strings.TrimSpace(line[1:]))
+		}
+		return nil
+	}
+	if user != nil {
+		// redis://:pass@host and redis://pass@host are password-only.
+		args := []string{"AUTH", user.Username()}
+		if pass, ok := user.Password(); ok {
+			args = append(args, pass)
+			if user.Username() == "" {
+				args = []string{"AUTH", pass}
+			}
+		}
+		if err := cmd(args...); err != nil {
+			return err
+		}
+	}
+	return cmd("RPUSH", key, string(payload))
+}
+
+// githubNotifier commits each posted day as JSON to a file in a GitHub repo
+// (contents API), building a public, versioned history of schedules.
+type githubNotifier struct {
+	api, token, repo, path string
+}
+
+func (g githubNotifier) Notify(ctx context.Context, day DayInfo, msg string) error {
+	content, err := json.MarshalIndent(day, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := strings.NewReplacer("{date}", day.Date, "{region}", day.Region).Replace(g.path)
+	endpoint := g.api + "/repos/" + g.repo + "/contents/" + path
+	// Updating an existing file needs its current blob sha.
+	var existing struct {
+		SHA string `json:"sha"`
+	}
+	if err := g.do(ctx, http.MethodGet, endpoint, nil, &existing); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	body, _ := json.Marshal(struct {
+		Message string `json:"message"`
+		Content string `json:"content"`
+		SHA     string `json:"sha,omitempty"`
+	}{"графік на " + schedule.ToDM(day.Date), base64.StdEncoding.EncodeToString(append(content, '\n')), existing.SHA})
+	return g.do(ctx, http.MethodPut, endpoint, body, nil)
+}
+
+// do calls the GitHub API, decoding the response into out when non-nil. A 404
+// is reported as fs.ErrNotExist.
+func (g githubNotifier) do(ctx context.Context, method, endpoint string, body []byte, out any) error {
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+g.token)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer drainClose(resp.Body)
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("github %s %s: %w", method, endpoint, fs.ErrNotExist)
+	}
+	if resp.StatusCode/100 != 2 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("github status %d: %s", resp.StatusCode, string(b))
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// plainText turns a MarkdownV2 message into plain text: the markers are
+// dropped and escaped characters are kept as they are.
+func plainText(msg string) string {
+	var b strings.Builder
+	escaped := false
+	for _, r := range msg {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+			continue
+		case r == '*' || r == '_' || r == '`':
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// markdownV2Reserved are the characters MarkdownV2 wants backslash-escaped in
+// plain text. Every message is built as MarkdownV2: the text around the
+// markup is written escaped and dynamic parts go through escapeMarkdownV2.
+const markdownV2Reserved = "_*[]()~`>#+-=|{}.!\\"
+
+// escapeMarkdownV2 escapes every MarkdownV2 reserved character in s, for
+// text that must not be read as markup.
+func escapeMarkdownV2(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(markdownV2Reserved, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// escapeLinkV2 escapes a URL for the (...) part of a MarkdownV2 link.
+func escapeLinkV2(u string) string {
+	return strings.NewReplacer("\\", "\\\\", ")", "\\)").Replace(u)
+}
+
+// sendTelegram posts text, retrying 429s, 5xx and network errors up to
+// POWERBOT_TELEGRAM_RETRIES attempts with exponential backoff from 1s. A 429's
+// retry_after takes precedence over the backoff.
+func sendTelegram(ctx context.Context, token, chatID, thread, text string) error {
+	_, err := sendTelegramReply(ctx, token, chatID, thread, text, 0)
+	return err
+}
+
+// sendTelegramReply is sendTelegram as a reply to message replyTo (0 for
+// none), returning the new message's id.
+func sendTelegramReply(ctx context.Context, token, chatID, thread, text string, replyTo int) (int, error) {
+	attempts := defaultTelegramRetries
+	if v := os.Getenv(telegramRetriesEnv); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			attempts = n
+		} else {
+			logf("warning: invalid %s %q, using %d", telegramRetriesEnv, v, defaultTelegramRetries)
+		}
+	}
+	backoff := telegramBackoff
+	for i := 1; ; i++ {
+		id, err := sendTelegramOnce(ctx, token, chatID, thread, text, replyTo)
+		var te *telegramError
+		if err == nil || ctx.Err() != nil || i >= attempts || (errors.As(err, &te) && !te.temporary()) {
+			return id, err
+		}
+		wait := backoff
+		if te != nil && te.retryAfter > 0 {
+			wait = te.retryAfter
+		}
+		logKV("warn", "telegram send failed, retrying", "attempt", i, "of", attempts, "wait", wait, "err", err)
+		sleepCtx(ctx, wait)
+		backoff *= 2
+	}
+}
+
+// telegramError is a non-200 reply from the Bot API.
+type telegramError struct {
+	status     int
+	retryAfter time.Duration
+	body       string
+}
+
+func (e *telegramError) Error() string {
+	return fmt.Sprintf("telegram status %d: %s", e.status, e.body)
+}
+
+func (e *telegramError) temporary() bool {
+	return e.status == http.StatusTooManyRequests || e.status >= 500
+}
+
+// telegramAPI POSTs a form to a Bot API method and decodes its result into
+// out when non-nil.
+func telegramAPI(ctx context.Context, token, method string, payload, out any) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://api.telegram.org/bot"+token+"/"+method, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := telegramClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer drainClose(resp.Body)
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode != 200 {
+		return &telegramError{status: resp.StatusCode, body: string(body)}
+	}
+	if out == nil {
+		return nil
+	}
+	var reply struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(body, &reply); err != nil {
+		return err
+	}
+	return json.Unmarshal(reply.Result, out)
+}
+
+// messagePayload is the sendMessage/editMessageText JSON body for one of our
+// Markdown messages, converted to MarkdownV2.
+func messagePayload(chatID, thread, text string) map[string]any {
+	payload := map[string]any{"chat_id": chatID, "text": text, "parse_mode": "MarkdownV2"}
+	if disablePreview(text) {
+		payload["disable_web_page_preview"] = true
+	}
+	if thread != "" {
+		if id, err := strconv.Atoi(thread); err == nil {
+			payload["message_thread_id"] = id
 		} else {
-			buf.WriteString(fmt.Sprintf("%%%02X", c))
+			payload["message_thread_id"] = thread
+		}
+	}
+	return payload
+}
+
+// disablePreview reports whether to suppress Telegram's link preview for text:
+// per POWERBOT_DISABLE_PREVIEW if set, otherwise whenever text has a URL, so
+// a source link doesn't push the schedule down.
+func disablePreview(text string) bool {
+	if v := os.Getenv(disablePreviewEnv); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err == nil {
+			return b
+		}
+		logf("warning: invalid %s %q, using the default", disablePreviewEnv, v)
+	}
+	return strings.Contains(text, "://")
+}
+
+func sendTelegramOnce(ctx context.Context, token, chatID, thread, text string, replyTo int) (int, error) {
+	payload := messagePayload(chatID, thread, text)
+	if replyTo != 0 {
+		// The parent may have been deleted; post unthreaded then.
+		payload["reply_to_message_id"] = replyTo
+		payload["allow_sending_without_reply"] = true
+	}
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://api.telegram.org/bot"+token+"/sendMessage", bytes.NewReader(b))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := telegramClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer drainClose(resp.Body)
+	if resp.StatusCode != 200 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		te := &telegramError{status: resp.StatusCode, body: string(body)}
+		var reply struct {
+			Parameters struct {
+				RetryAfter int `json:"retry_after"`
+			} `json:"parameters"`
+		}
+		if json.Unmarshal(body, &reply) == nil && reply.Parameters.RetryAfter > 0 {
+			te.retryAfter = time.Duration(reply.Parameters.RetryAfter) * time.Second
+		} else if n, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && n > 0 {
+			te.retryAfter = time.Duration(n) * time.Second
+		}
+		return 0, te
+	}
+	var reply struct {
+		Result struct {
+			MessageID int `json:"message_id"`
+		} `json:"result"`
+	}
+	json.NewDecoder(resp.Body).Decode(&reply)
+	return reply.Result.MessageID, nil
+}
+
+// sendPhoto posts an image, uploaded as name, with msg as its Markdown
+// caption.
+func sendPhoto(ctx context.Context, token, chatID, thread string, img []byte, name, caption string) error {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fields := [][2]string{{"chat_id", chatID}, {"caption", caption}, {"parse_mode", "MarkdownV2"}}
+	if thread != "" {
+		fields = append(fields, [2]string{"message_thread_id", thread})
+	}
+	for _, f := range fields {
+		if err := mw.WriteField(f[0], f[1]); err != nil {
+			return err
+		}
+	}
+	fw, err := mw.CreateFormFile("photo", name)
+	if err != nil {
+		return err
+	}
+	if _, err := fw.Write(img); err != nil {
+		return err
+	}
+	if err := mw.Close(); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://api.telegram.org/bot"+token+"/sendPhoto", &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	resp, err := telegramClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer drainClose(resp.Body)
+	if resp.StatusCode != 200 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("telegram status %d: %s", resp.StatusCode, string(b))
+	}
+	return nil
+}
+
+// renderDayPNG draws one 24-hour row per group, in the order given, outage
+// minutes in red, the rest in green, with a tick at every hour. Labels live
+// in the caption.
+func renderDayPNG(day DayInfo, groups []groupSpec) ([]byte, error) {
+	const (
+		pxPerHour = 30
+		rowHeight = 40
+		gap       = 8
+	)
+	var (
+		bg      = color.RGBA{0xff, 0xff, 0xff, 0xff}
+		on      = color.RGBA{0x8b, 0xc3, 0x4a, 0xff}
+		off     = color.RGBA{0xe5, 0x39, 0x35, 0xff}
+		unknown = color.RGBA{0xbd, 0xbd, 0xbd, 0xff}
+		tick    = color.RGBA{0x42, 0x42, 0x42, 0xff}
+	)
+	width := 24*pxPerHour + 2*gap
+	height := len(groups)*(rowHeight+gap) + gap
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), &image.Uniform{bg}, image.Point{}, draw.Src)
+	for row, g := range groups {
+		y0 := gap + row*(rowHeight+gap)
+		rowRect := image.Rect(gap, y0, gap+24*pxPerHour, y0+rowHeight)
+		info, ok := day.Groups[g.Name]
+		if !ok {
+			draw.Draw(img, rowRect, &image.Uniform{unknown}, image.Point{}, draw.Src)
+			continue
+		}
+		draw.Draw(img, rowRect, &image.Uniform{on}, image.Point{}, draw.Src)
+		for _, iv := range schedule.ParseIntervals(info.Text) {
+			x0 := gap + iv.Start*pxPerHour/60
+			// The part of a window past midnight belongs to the next day's picture.
+			x1 := gap + min(iv.End, 24*60)*pxPerHour/60
+			draw.Draw(img, image.Rect(x0, y0, x1, y0+rowHeight), &image.Uniform{off}, image.Point{}, draw.Src)
+		}
+		for h := 0; h <= 24; h++ {
+			x := gap + h*pxPerHour
+			draw.Draw(img, image.Rect(x, y0, x+1, y0+rowHeight), &image.Uniform{tick}, image.Point{}, draw.Src)
 		}
 	}
-	return buf.String()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// jsonLogs is POWERBOT_LOG_FORMAT=json, resolved once at startup.
+var jsonLogs bool
+
+// logLevels maps the prefixes log lines use to their level; the rest are info.
+var logLevels = []struct{ prefix, level string }{
+	{"debug: ", "debug"},
+	{"warning: ", "warn"},
+	{"error: ", "error"},
 }
 
 func logf(format string, args ...interface{}) {
-	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	msg := fmt.Sprintf(format, args...)
+	for _, l := range logLevels {
+		if rest, ok := strings.CutPrefix(msg, l.prefix); ok {
+			logKV(l.level, rest)
+			return
+		}
+	}
+	logKV("info", msg)
+}
+
+// logKV logs msg at level (debug, info, warn or error) with key/value
+// fields: as one JSON object per line with POWERBOT_LOG_FORMAT=json, else as
+// the prefixed text line followed by key=value pairs.
+func logKV(level, msg string, kv ...any) {
+	if len(kv)%2 != 0 {
+		kv = append(kv[:len(kv)-1:len(kv)-1], "!BADKEY", kv[len(kv)-1])
+	}
+	if jsonLogs {
+		logJSON(time.Now(), level, msg, kv)
+		return
+	}
+	var b strings.Builder
+	for _, l := range logLevels {
+		if l.level == level {
+			b.WriteString(l.prefix)
+		}
+	}
+	b.WriteString(msg)
+	for i := 0; i < len(kv); i += 2 {
+		v := fmt.Sprint(kv[i+1])
+		if v == "" || strings.ContainsAny(v, " \t\n\"=") {
+			v = strconv.Quote(v)
+		}
+		fmt.Fprintf(&b, " %v=%s", kv[i], v)
+	}
+	fmt.Fprintln(os.Stderr, b.String())
+}
+
+// logJSON writes one log entry as a JSON object for journald and log
+// shippers, with ts, level and msg first and the fields after them in order.
+func logJSON(now time.Time, level, msg string, kv []any) {
+	encode := func(v any) []byte {
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		if enc.Encode(v) != nil {
+			buf.Reset()
+			enc.Encode(fmt.Sprint(v))
+		}
+		return bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+	}
+	var b bytes.Buffer
+	field := func(k string, v any) {
+		switch x := v.(type) {
+		case error:
+			v = x.Error()
+		case time.Duration:
+			v = x.String()
+		}
+		if b.Len() > 0 {
+			b.WriteByte(',')
+		}
+		b.Write(encode(k))
+		b.WriteByte(':')
+		b.Write(encode(v))
+	}
+	field("ts", now.Format(time.RFC3339Nano))
+	field("level", level)
+	field("msg", msg)
+	for i := 0; i < len(kv); i += 2 {
+		field(fmt.Sprint(kv[i]), kv[i+1])
+	}
+	fmt.Fprintf(os.Stderr, "{%s}\n", b.String())
 }
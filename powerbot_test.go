@@ -0,0 +1,2984 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image/png"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/akchonya/loedormbot/internal/schedule"
+)
+
+const page = `<p><b>Графік погодинних відключень на 12.12.2025</b></p>` +
+	`<p>Група 4.1. Електроенергії немає з 8:00 до 12:00.</p>` +
+	`<p>Група 6.1. Електроенергії немає з 14:00:00 до 16:00.</p>` +
+	`<p><b>Графік погодинних відключень на 13.12.2025</b></p>` +
+	`<p>Група 6.1. Електроенергія є.</p>` +
+	`<p>Група 4.1. Електроенергії немає з 10:00 до 11:00.</p>` +
+	`<p>© LOE</p><p>Група 6.1. Електроенергії немає з 00:00 до 24:00.</p>`
+
+var update = flag.Bool("update", false, "rewrite testdata/scenario.out")
+
+// redirect sends every request made through the bot's HTTP clients to srv,
+// whatever host it was addressed to.
+func redirect(t *testing.T, srv *httptest.Server) {
+	t.Helper()
+	for _, c := range []*http.Client{http.DefaultClient, httpClient, telegramClient} {
+		saved := c.Transport
+		c.Transport = hostRewriter{host: srv.Listener.Addr().String()}
+		t.Cleanup(func() { c.Transport = saved })
+	}
+}
+
+type hostRewriter struct{ host string }
+
+func (h hostRewriter) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme, req.URL.Host = "http", h.host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// day builds a DayInfo for date with the given group texts; minutes are
+// taken from the text as the parser would.
+func day(date string, groups map[string]string) DayInfo {
+	d := DayInfo{Date: date, Groups: map[string]GroupInfo{}}
+	t, _ := time.Parse("2006-01-02", date)
+	for name, text := range groups {
+		d.Groups[name] = GroupInfo{Text: text, Minutes: schedule.OutageMinutes(text, t, nil)}
+	}
+	return d
+}
+
+// setEnv sets env for the test, restoring the previous values afterwards.
+func setEnv(t *testing.T, env map[string]string) {
+	t.Helper()
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+}
+
+// apiBody wraps html the way the LOE API returns it.
+func apiBody(html string) string {
+	b, _ := json.Marshal(map[string]any{
+		"hydra:member": []any{map[string]any{
+			"menuItems": []any{map[string]string{"name": "Графік", "rawHtml": html}},
+		}},
+	})
+	return string(b)
+}
+
+// telegramPayload decodes the JSON body of a Bot API request, rendering
+// every value as a string.
+func telegramPayload(t *testing.T, r *http.Request) map[string]string {
+	t.Helper()
+	var raw map[string]any
+	if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+		t.Errorf("%s: body is not JSON: %v", r.URL.Path, err)
+	}
+	out := map[string]string{}
+	for k, v := range raw {
+		out[k] = fmt.Sprint(v)
+	}
+	return out
+}
+
+// captureStderr returns what f writes to os.Stderr.
+func captureStderr(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := os.Stderr
+	os.Stderr = w
+	defer func() { os.Stderr = saved }()
+	f()
+	w.Close()
+	b, _ := io.ReadAll(r)
+	return string(b)
+}
+
+func TestCompactLine(t *testing.T) {
+	d := DayInfo{Date: "2025-12-12", Groups: map[string]GroupInfo{
+		groupPower: {Text: "немає з 08:00 до 10:00, з 12:00 до 15:00", Minutes: 300},
+		groupWater: {Text: "немає з 08:00 до 08:20", Minutes: 20},
+	}}
+	missing := DayInfo{Date: "2025-12-12", Groups: map[string]GroupInfo{groupPower: {Minutes: 0}}}
+	tests := []struct {
+		name    string
+		day     DayInfo
+		update  bool
+		worse   int
+		cleared []string
+		want    string
+	}{
+		{name: "new", day: d, want: "12\\.12: 💡5ч 💧0\\.3ч"},
+		{name: "update, much worse", day: d, update: true, worse: 90, want: "upd\\. 😩 12\\.12: 💡5ч 💧0\\.3ч"},
+		{name: "update, a little worse", day: d, update: true, worse: 20, want: "upd\\. 😕 12\\.12: 💡5ч 💧0\\.3ч"},
+		{name: "update, less", day: d, update: true, want: "upd\\. 🍾 12\\.12: 💡5ч 💧0\\.3ч"},
+		{name: "update, cleared", day: d, update: true, worse: 90, cleared: []string{groupWater}, want: "🎉 upd\\. 12\\.12: 💡5ч 💧0\\.3ч"},
+		{name: "missing group", day: missing, want: "12\\.12: 💡0ч 💧н/д"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := compactLine(tt.day, schedule.ToDM(tt.day.Date), tt.update, tt.worse, tt.cleared, watched); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeSMTP accepts one SMTP session on a local port and hands over the
+// message sent with DATA.
+func fakeSMTP(t *testing.T) (addr string, data <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("no local listener: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	got := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+		reply("220 fake ESMTP")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				reply("250 fake")
+			case cmd == "DATA":
+				reply("354 go ahead")
+				var msg strings.Builder
+				for {
+					l, err := r.ReadString('\n')
+					if err != nil || l == ".\r\n" {
+						break
+					}
+					msg.WriteString(l)
+				}
+				got <- msg.String()
+				reply("250 queued")
+			case cmd == "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+	return ln.Addr().String(), got
+}
+
+func TestSMTPNotifier(t *testing.T) {
+	addr, data := fakeSMTP(t)
+	host, _, _ := net.SplitHostPort(addr)
+	n := smtpNotifier{addr: addr, host: host, from: "bot@example.com", to: []string{"a@example.com", "b@example.com"}}
+	day := DayInfo{Date: "2025-12-12"}
+	if err := n.Notify(context.Background(), day, "*графік на 12.12*\n*💡 світла не буде*: немає з 08:00 до 12:00"); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	msg := <-data
+	head, body, ok := strings.Cut(msg, "\r\n\r\n")
+	if !ok {
+		t.Fatalf("no header/body split in %q", msg)
+	}
+	var subject string
+	for _, line := range strings.Split(head, "\r\n") {
+		if v, ok := strings.CutPrefix(line, "Subject: "); ok {
+			subject, _ = new(mime.WordDecoder).DecodeHeader(v)
+		}
+	}
+	if subject != "Графік на 12.12" {
+		t.Errorf("subject = %q", subject)
+	}
+	if !strings.Contains(head, "To: a@example.com, b@example.com\r\n") {
+		t.Errorf("header = %q", head)
+	}
+	if want := "графік на 12.12\r\n💡 світла не буде: немає з 08:00 до 12:00\r\n"; body != want {
+		t.Errorf("body = %q, want %q", body, want)
+	}
+}
+
+func TestSeenTracking(t *testing.T) {
+	d := day("2025-12-12", map[string]string{groupPower: "немає з 08:00 до 12:00"})
+	changed := day("2025-12-12", map[string]string{groupPower: "немає з 08:00 до 13:00"})
+	st := markSeen(State{}, "1", d)
+	notifiers := []Notifier{telegramNotifier{chatID: "1"}, telegramNotifier{chatID: "2"}}
+	tests := []struct {
+		name  string
+		track string
+		days  []DayInfo
+		want  []string
+	}{
+		{name: "tracking off", days: []DayInfo{d}, want: []string{"1", "2"}},
+		{name: "seen chat skipped", track: "1", days: []DayInfo{d}, want: []string{"2"}},
+		{name: "changed schedule", track: "1", days: []DayInfo{changed}, want: []string{"1", "2"}},
+		{name: "run with one unseen day", track: "1", days: []DayInfo{d, changed}, want: []string{"1", "2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(trackSeenEnv, tt.track)
+			var got []string
+			for _, n := range unseen(st, notifiers, tt.days...) {
+				got = append(got, n.(telegramNotifier).chatID)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("unseen = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	t.Setenv(trackSeenEnv, "1")
+	st = markPushed(st, changed, []string{"2"})
+	if needsUpdate(st, "2", changed) || !needsUpdate(st, "1", changed) {
+		t.Errorf("after markPushed: seen = %v", st.Seen)
+	}
+}
+
+func TestLoadContentDeadline(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer srv.Close()
+	redirect(t, srv)
+	t.Setenv(testFileEnv, "")
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, _, err := loadContent(ctx, State{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want the deadline", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("loadContent took %s past a 100ms deadline", d)
+	}
+}
+
+func TestHTTPClientTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer srv.Close()
+	redirect(t, srv)
+	t.Setenv(testFileEnv, "")
+	saved := httpClient.Timeout
+	httpClient.Timeout = 100 * time.Millisecond
+	defer func() { httpClient.Timeout = saved }()
+	start := time.Now()
+	if _, _, err := loadContent(context.Background(), State{}); err == nil {
+		t.Error("loadContent succeeded against a hung server")
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("loadContent took %s with a 100ms client timeout", d)
+	}
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	st := State{
+		Days:   []DayInfo{{Date: "2025-12-12", Groups: map[string]GroupInfo{groupPower: {Text: "немає з 08:00 до 12:00", Minutes: 240}}}},
+		Seen:   map[string]map[string]string{"-100": {"2025-12-12": "abc"}},
+		Warned: []string{"2025-12-12"},
+	}
+	tests := []struct {
+		name    string
+		file    string
+		compact string
+		format  string
+	}{
+		{name: "json", file: "state.json"},
+		{name: "compact json", file: "state.json", compact: "1"},
+		{name: "gob by extension", file: "state.gob"},
+		{name: "gob by format", file: "state.json", format: "gob"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(stateCompactEnv, tt.compact)
+			t.Setenv(stateFormatEnv, tt.format)
+			path := filepath.Join(t.TempDir(), tt.file)
+			if err := saveState(path, st); err != nil {
+				t.Fatalf("save: %v", err)
+			}
+			b, _ := os.ReadFile(path)
+			if isJSON := bytes.HasPrefix(b, []byte("{")); isJSON != (tt.format == "" && tt.file == "state.json") {
+				t.Errorf("JSON = %v for %s", isJSON, tt.name)
+			} else if indented := bytes.Contains(b, []byte("\n  ")); isJSON && indented != (tt.compact == "") {
+				t.Errorf("indented = %v in %s", indented, b)
+			}
+			got, err := loadState(path)
+			if err != nil {
+				t.Fatalf("load: %v", err)
+			}
+			want := st
+			want.Version = stateVersion
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("loaded %+v\nwant %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestTelegramPhoto(t *testing.T) {
+	type upload struct {
+		path, chatID, caption string
+		photo                 []byte
+	}
+	got := make(chan upload, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var u upload
+		u.path = r.URL.Path
+		if err := r.ParseMultipartForm(1 << 20); err == nil {
+			u.chatID, u.caption = r.FormValue("chat_id"), r.FormValue("caption")
+			if f, _, err := r.FormFile("photo"); err == nil {
+				u.photo, _ = io.ReadAll(f)
+			}
+		}
+		got <- u
+	}))
+	defer srv.Close()
+	redirect(t, srv)
+	t.Setenv(imageEnv, "1")
+	day := DayInfo{Date: "2025-12-12", Groups: map[string]GroupInfo{groupPower: {Text: "немає з 08:00 до 12:00", Minutes: 240}}}
+	n := telegramNotifier{token: "TOKEN", chatID: "-100"}
+	if err := n.Notify(context.Background(), day, "*графік на 12.12*"); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	u := <-got
+	if u.path != "/botTOKEN/sendPhoto" || u.chatID != "-100" || u.caption != "*графік на 12.12*" {
+		t.Errorf("upload = %s chat %q caption %q", u.path, u.chatID, u.caption)
+	}
+	if !bytes.HasPrefix(u.photo, []byte("\x89PNG\r\n\x1a\n")) {
+		t.Fatalf("photo is not a PNG: % x", u.photo[:min(len(u.photo), 8)])
+	}
+	img, err := png.Decode(bytes.NewReader(u.photo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// One 40px row per watched group with 8px gaps, 30px per hour.
+	if b := img.Bounds(); b.Dx() != 24*30+16 || b.Dy() != len(watched)*48+8 {
+		t.Errorf("image is %v", b)
+	}
+	for row, g := range watched {
+		r, gr, _, _ := img.At(8+10*30+15, 8+row*48+20).RGBA()
+		outage := r>>8 == 0xe5 && gr>>8 == 0x39
+		if want := g.Name == groupPower; outage != want {
+			t.Errorf("%s at 10:30: outage colour %v, want %v", g.Name, outage, want)
+		}
+	}
+
+	// A subscriber following one group gets a picture of just that row.
+	var only []groupSpec
+	for _, g := range watched {
+		if g.Name == groupPower {
+			only = append(only, g)
+		}
+	}
+	n.only = only
+	if err := n.Notify(context.Background(), day, "*графік на 12.12*"); err != nil {
+		t.Fatalf("Notify filtered: %v", err)
+	}
+	u = <-got
+	img, err = png.Decode(bytes.NewReader(u.photo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dy() != 48+8 {
+		t.Errorf("filtered image is %v, want one row", b)
+	}
+	if r, gr, _, _ := img.At(8+10*30+15, 8+20).RGBA(); r>>8 != 0xe5 || gr>>8 != 0x39 {
+		t.Errorf("filtered row at 10:30 is not an outage")
+	}
+}
+
+func TestPingHealthcheck(t *testing.T) {
+	got := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		got <- r.Method + " " + r.URL.Path + " " + string(b)
+	}))
+	defer srv.Close()
+	t.Setenv(pingURLEnv, srv.URL+"/abc/")
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{name: "success", want: "POST /abc/ ok"},
+		{name: "failure", err: errors.New("fetch: timeout"), want: "POST /abc/fail fetch: timeout"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pingHealthcheck(tt.err)
+			if g := <-got; g != tt.want {
+				t.Errorf("got %q, want %q", g, tt.want)
+			}
+		})
+	}
+}
+
+func TestSaveStateRetryFallback(t *testing.T) {
+	dir := t.TempDir()
+	// The primary's directory is a plain file, so every attempt fails.
+	blocker := filepath.Join(dir, "blocker")
+	os.WriteFile(blocker, nil, 0o644)
+	primary := filepath.Join(blocker, "state.json")
+	fallback := filepath.Join(dir, "fallback", "state.json")
+	t.Setenv(stateFallbackEnv, fallback)
+	st := State{Days: []DayInfo{{Date: "2025-12-12", Groups: map[string]GroupInfo{groupPower: {Text: "немає з 08:00 до 12:00", Minutes: 240}}}}}
+	if err := saveStateRetry(primary, st); err != nil {
+		t.Fatalf("saveStateRetry: %v", err)
+	}
+	got, err := loadState(fallback)
+	if err != nil {
+		t.Fatalf("fallback: %v", err)
+	}
+	if st.Version = stateVersion; !reflect.DeepEqual(got, st) {
+		t.Errorf("fallback holds %+v, want %+v", got, st)
+	}
+	t.Setenv(stateFallbackEnv, "")
+	if err := saveStateRetry(primary, st); err == nil {
+		t.Error("saveStateRetry succeeded with no writable path")
+	}
+}
+
+func TestCompareDay(t *testing.T) {
+	old := day("2025-12-12", map[string]string{groupPower: "немає з 08:00 до 12:00", groupWater: "немає з 14:00 до 16:00"})
+	tests := []struct {
+		name    string
+		tol     string
+		zero    string
+		cur     DayInfo
+		changed bool
+		worse   int
+		cleared []string
+	}{
+		{name: "same", cur: old},
+		{name: "same windows, other wording", cur: day("2025-12-12", map[string]string{groupPower: "немає з 08:00 до 12:00", groupWater: "Світла немає з 14:00 до 16:00."})},
+		{
+			name:    "window split in two",
+			cur:     day("2025-12-12", map[string]string{groupPower: "немає з 08:00 до 10:00 та з 10:00 до 12:00", groupWater: "немає з 14:00 до 16:00"}),
+			changed: true,
+		},
+		{
+			name:    "longer outage",
+			cur:     day("2025-12-12", map[string]string{groupPower: "немає з 07:00 до 13:00", groupWater: "немає з 14:00 до 16:00"}),
+			changed: true,
+			worse:   120,
+		},
+		{
+			name:    "longer within tolerance",
+			tol:     "60",
+			cur:     day("2025-12-12", map[string]string{groupPower: "немає з 07:30 до 12:00", groupWater: "немає з 14:00 до 16:00"}),
+			changed: true,
+		},
+		{
+			name:    "longer past tolerance",
+			tol:     "20",
+			cur:     day("2025-12-12", map[string]string{groupPower: "немає з 07:30 до 12:00", groupWater: "немає з 14:00 до 16:00"}),
+			changed: true,
+			worse:   30,
+		},
+		{
+			name: "zero only, windows moved",
+			zero: "1",
+			cur:  day("2025-12-12", map[string]string{groupPower: "немає з 07:00 до 13:00", groupWater: "немає з 15:00 до 16:00"}),
+		},
+		{
+			name:    "zero only, outage gone",
+			zero:    "1",
+			cur:     day("2025-12-12", map[string]string{groupPower: "буде!!!!", groupWater: "немає з 14:00 до 16:00"}),
+			changed: true,
+			cleared: []string{groupPower},
+		},
+		{
+			name:    "cleared",
+			cur:     day("2025-12-12", map[string]string{groupPower: "немає з 08:00 до 12:00", groupWater: "буде!!!!"}),
+			changed: true,
+			cleared: []string{groupWater},
+		},
+		{
+			name:    "new images",
+			cur:     DayInfo{Date: "2025-12-12", Groups: old.Groups, Images: []string{"/a.png"}},
+			changed: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(minutesToleranceEnv, tt.tol)
+			t.Setenv(zeroTransitionsEnv, tt.zero)
+			changed, worse, cleared := compareDay(old, tt.cur)
+			if changed != tt.changed || worse != tt.worse || !reflect.DeepEqual(cleared, tt.cleared) {
+				t.Errorf("compareDay = %v, %d, %q; want %v, %d, %q", changed, worse, cleared, tt.changed, tt.worse, tt.cleared)
+			}
+		})
+	}
+}
+
+func TestFormatSchedule(t *testing.T) {
+	d := day("2025-12-12", map[string]string{groupPower: "немає з 08:00 до 10:00, з 12:00 до 15:00"})
+	tests := []struct {
+		name    string
+		env     map[string]string
+		day     DayInfo
+		update  bool
+		worse   int
+		cleared []string
+		want    string
+	}{
+		{
+			name: "new",
+			day:  d,
+			want: "*графік на 12\\.12*\n*💡 світла не буде*: немає з 08:00 до 10:00, з 12:00 до 15:00\n*💧 води не буде*: н/д",
+		},
+		{
+			name:   "update",
+			day:    d,
+			update: true,
+			worse:  90,
+			want:   "*upd\\. 😩 на 12\\.12*\n*💡 світла не буде*: немає з 08:00 до 10:00, з 12:00 до 15:00\n*💧 води не буде*: н/д",
+		},
+		{
+			name:   "update, a little worse",
+			day:    d,
+			update: true,
+			worse:  20,
+			want:   "*upd\\. 😕 на 12\\.12*\n*💡 світла не буде*: немає з 08:00 до 10:00, з 12:00 до 15:00\n*💧 води не буде*: н/д",
+		},
+		{
+			name: "other region",
+			day:  DayInfo{Date: "2025-12-12", Region: "kyiv", Groups: d.Groups},
+			want: "*графік на 12\\.12 \\(kyiv\\)*\n*💡 світла не буде*: немає з 08:00 до 10:00, з 12:00 до 15:00\n*💧 води не буде*: н/д",
+		},
+		{
+			name: "own region",
+			env:  map[string]string{regionEnv: "kyiv"},
+			day:  DayInfo{Date: "2025-12-12", Region: "kyiv", Groups: d.Groups},
+			want: "*графік на 12\\.12*\n*💡 світла не буде*: немає з 08:00 до 10:00, з 12:00 до 15:00\n*💧 води не буде*: н/д",
+		},
+		{
+			name: "max intervals",
+			env:  map[string]string{maxIntervalsEnv: "1", notFoundEnv: "?"},
+			day:  d,
+			want: "*графік на 12\\.12*\n*💡 світла не буде*: немає з 08:00 до 10:00 \\(\\+1 ще\\)\n*💧 води не буде*: ?",
+		},
+		{
+			name: "show longest",
+			env:  map[string]string{showLongestEnv: "1"},
+			day:  d,
+			want: "*графік на 12\\.12*\n*💡 світла не буде*: немає з 08:00 до 10:00, з 12:00 до 15:00 \\(найдовше: 3 год\\)\n*💧 води не буде*: н/д",
+		},
+		{
+			name: "combine same",
+			env:  map[string]string{combineSameEnv: "1"},
+			day:  day("2025-12-12", map[string]string{groupPower: "немає з 08:00 до 10:00", groupWater: "Немає з 8:00 до 10:00"}),
+			want: "*графік на 12\\.12*\n*💡💧 світла і води не буде*: немає з 08:00 до 10:00",
+		},
+		{
+			name: "not found text",
+			env:  map[string]string{notFoundEnv: "?"},
+			day:  d,
+			want: "*графік на 12\\.12*\n*💡 світла не буде*: немає з 08:00 до 10:00, з 12:00 до 15:00\n*💧 води не буде*: ?",
+		},
+		{
+			name:    "cleared",
+			day:     day("2025-12-12", map[string]string{groupPower: "немає з 08:00 до 10:00", groupWater: schedule.AvailableText}),
+			update:  true,
+			worse:   90,
+			cleared: []string{groupWater},
+			want:    "*upd\\. 😩 на 12\\.12*\n*💡 світла не буде*: немає з 08:00 до 10:00\n*💧 води не буде*: буде\\!\\!\\!\\!\n🎉 💧 4\\.1: відключення скасовано",
+		},
+		{
+			name:    "cleared, celebrated",
+			env:     map[string]string{celebrateEnv: "1"},
+			day:     day("2025-12-12", map[string]string{groupPower: "немає з 08:00 до 10:00", groupWater: schedule.AvailableText}),
+			update:  true,
+			worse:   90,
+			cleared: []string{groupWater},
+			want:    "*🎉 upd\\. на 12\\.12: 4\\.1 буде\\!*\n*💡 світла не буде*: немає з 08:00 до 10:00\n*💧 води не буде*: буде\\!\\!\\!\\!",
+		},
+		{
+			name: "picture",
+			day:  DayInfo{Date: "2025-12-12", Images: []string{"/a.png"}},
+			want: "*графік на 12\\.12*\nграфік опубліковано зображенням",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setEnv(t, tt.env)
+			defer func(saved int) { maxIntervals = saved }(maxIntervals)
+			maxIntervals = loadMaxIntervals()
+			if got := formatSchedule(tt.day, tt.update, tt.worse, tt.cleared, watched); got != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPublishIPC(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "powerbot.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Skipf("no unix sockets: %v", err)
+	}
+	defer ln.Close()
+	got := make(chan []byte, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			b, _ := io.ReadAll(conn)
+			conn.Close()
+			got <- b
+		}
+	}()
+	days := []DayInfo{day("2025-12-12", map[string]string{groupPower: "немає з 08:00 до 12:00"})}
+	publishIPC(sock, days)
+	var back []DayInfo
+	if b := <-got; json.Unmarshal(b, &back) != nil || !reflect.DeepEqual(back, days) {
+		t.Errorf("socket got %s", b)
+	}
+	publishIPC(sock, nil)
+	if b := <-got; string(b) != "[]\n" {
+		t.Errorf("no days sent as %q, want an empty array", b)
+	}
+	// Nobody listening is not an error worth more than a debug line.
+	publishIPC(filepath.Join(t.TempDir(), "missing.sock"), days)
+}
+
+func TestPushMetrics(t *testing.T) {
+	type push struct{ method, path, ctype, body string }
+	got := make(chan push, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		got <- push{r.Method, r.URL.Path, r.Header.Get("Content-Type"), string(b)}
+	}))
+	defer srv.Close()
+	reset := func() {
+		for _, c := range []interface{ Store(int64) }{&metrics.fetchErrors, &metrics.parseErrors, &metrics.postsNew, &metrics.postsUpdate, &metrics.postErrors, &metrics.lastSuccess} {
+			c.Store(0)
+		}
+	}
+	reset()
+	defer reset()
+	metrics.postsNew.Add(2)
+	metrics.postErrors.Add(1)
+	pushMetrics(srv.URL + "/")
+	p := <-got
+	if p.method != http.MethodPost || p.path != "/metrics/job/powerbot" || !strings.HasPrefix(p.ctype, "text/plain") {
+		t.Errorf("pushed %s %s (%s)", p.method, p.path, p.ctype)
+	}
+	for _, want := range []string{
+		"powerbot_fetch_errors_total 0\n",
+		"powerbot_posts_total{type=\"new\"} 2\n",
+		"powerbot_posts_total{type=\"update\"} 0\n",
+		"powerbot_post_errors_total 1\n",
+	} {
+		if !strings.Contains(p.body, want) {
+			t.Errorf("body lacks %q:\n%s", want, p.body)
+		}
+	}
+	if strings.Contains(p.body, "powerbot_last_success_timestamp") {
+		t.Errorf("last success pushed before any successful run:\n%s", p.body)
+	}
+	metrics.lastSuccess.Store(1765526400)
+	pushMetrics(srv.URL)
+	if p := <-got; !strings.Contains(p.body, "powerbot_last_success_timestamp 1765526400\n") {
+		t.Errorf("body lacks the last success:\n%s", p.body)
+	}
+}
+
+func TestCheckDates(t *testing.T) {
+	today := time.Date(2025, 12, 12, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		lookahead string
+		want      int
+	}{
+		{"", 2},
+		{"0", 1},
+		{"3", 4},
+		{"-1", 2},
+		{"x", 2},
+	}
+	for _, tt := range tests {
+		t.Setenv(lookaheadEnv, tt.lookahead)
+		got := checkDates(today)
+		if len(got) != tt.want {
+			t.Errorf("%s=%q: %d dates, want %d", lookaheadEnv, tt.lookahead, len(got), tt.want)
+			continue
+		}
+		for i, d := range got {
+			if !d.Equal(today.AddDate(0, 0, i)) {
+				t.Errorf("%s=%q: date %d is %s", lookaheadEnv, tt.lookahead, i, d.Format("2006-01-02"))
+			}
+		}
+	}
+}
+
+func TestCheckBreaker(t *testing.T) {
+	setEnv(t, map[string]string{breakerMaxEnv: "2", breakerWindowEnv: "1h"})
+	start := time.Date(2025, 12, 12, 8, 0, 0, 0, time.UTC)
+	steps := []struct {
+		after  time.Duration
+		ok     bool
+		notice bool
+	}{
+		{0, true, false},
+		{10 * time.Minute, true, false},
+		{20 * time.Minute, false, true},
+		{30 * time.Minute, false, false},
+		{61 * time.Minute, true, false}, // the first update left the window
+	}
+	st := State{}
+	for i, s := range steps {
+		var ok, notice bool
+		st, ok, notice = checkBreaker(st, "2025-12-12", start.Add(s.after))
+		if ok != s.ok || notice != s.notice {
+			t.Errorf("step %d: ok, notice = %v, %v; want %v, %v", i, ok, notice, s.ok, s.notice)
+		}
+	}
+	t.Setenv(breakerMaxEnv, "")
+	if _, ok, _ := checkBreaker(st, "2025-12-12", start.Add(62*time.Minute)); !ok {
+		t.Error("breaker held an update while disabled")
+	}
+}
+
+func TestRelativeTime(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{-time.Minute, "зараз"},
+		{20 * time.Second, "зараз"},
+		{45 * time.Minute, "через 45 хв"},
+		{2*time.Hour + 15*time.Minute, "через 2 год 15 хв"},
+	}
+	for _, tt := range tests {
+		if got := relativeTime(tt.d); got != tt.want {
+			t.Errorf("relativeTime(%s) = %q, want %q", tt.d, got, tt.want)
+		}
+	}
+}
+
+func TestDayLink(t *testing.T) {
+	tests := []struct {
+		tmpl, want string
+	}{
+		{"", ""},
+		{" https://poweron.loe.lviv.ua/ ", "https://poweron.loe.lviv.ua/"},
+		{"https://example.com/g?d={date}#{dm}", "https://example.com/g?d=2025-12-05#05.12"},
+	}
+	for _, tt := range tests {
+		if got := dayLink(tt.tmpl, "2025-12-05"); got != tt.want {
+			t.Errorf("dayLink(%q) = %q, want %q", tt.tmpl, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeChatID(t *testing.T) {
+	tests := []struct {
+		in, want string
+		wantErr  bool
+	}{
+		{in: " -1001234567890 ", want: "-1001234567890"},
+		{in: "+42", want: "42"},
+		{in: "007", want: "7"},
+		{in: "@power_bot_chat", want: "@power_bot_chat"},
+		{in: "@abc", wantErr: true},
+		{in: "@1chat", wantErr: true},
+		{in: "0", wantErr: true},
+		{in: "chat", wantErr: true},
+		{in: "-100 123", wantErr: true},
+		{in: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := normalizeChatID(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("normalizeChatID(%q) = %q, %v; want %q, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestEscalateCritical(t *testing.T) {
+	var calls []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Date   string          `json:"date"`
+			Groups []criticalGroup `json:"groups"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		for _, g := range body.Groups {
+			calls = append(calls, body.Date+" "+g.Group)
+		}
+	}))
+	defer srv.Close()
+	setEnv(t, map[string]string{criticalWebhookEnv: srv.URL, criticalMinutesEnv: "720"})
+	ctx := context.Background()
+	mild := day("2025-12-12", map[string]string{groupPower: "немає з 08:00 до 20:00"})
+	st := escalateCritical(ctx, State{}, mild)
+	if len(calls) != 0 || len(st.Escalated) != 0 {
+		t.Fatalf("720 minutes escalated: %v", calls)
+	}
+	d := DayInfo{Date: "2025-12-13", Groups: map[string]GroupInfo{
+		groupPower: {Text: "немає з 05:00 до 20:00", Minutes: 900},
+		groupWater: {Text: "немає з 08:00 до 12:00", Minutes: 240},
+	}}
+	st = escalateCritical(ctx, st, d)
+	st = escalateCritical(ctx, st, d)
+	if len(calls) != 1 || calls[0] != "2025-12-13 "+groupPower {
+		t.Errorf("webhook calls = %q, want one for %s", calls, groupPower)
+	}
+}
+
+func TestDropFarFuture(t *testing.T) {
+	today := time.Date(2025, 12, 12, 0, 0, 0, 0, time.UTC)
+	days := []DayInfo{{Date: "2025-12-12"}, {Date: "2025-12-19"}, {Date: "2025-12-20"}, {Date: "2027-01-16"}}
+	tests := []struct {
+		max  string
+		want []string
+	}{
+		{"", []string{"2025-12-12", "2025-12-19"}},
+		{"0", []string{"2025-12-12"}},
+		{"399", []string{"2025-12-12", "2025-12-19", "2025-12-20"}},
+		{"x", []string{"2025-12-12", "2025-12-19"}},
+	}
+	for _, tt := range tests {
+		t.Setenv(maxFutureEnv, tt.max)
+		var got []string
+		for _, d := range dropFarFuture(days, today) {
+			got = append(got, d.Date)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s=%q: kept %v, want %v", maxFutureEnv, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestLoadContentConditional(t *testing.T) {
+	var gotETag, gotSince string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotETag, gotSince = r.Header.Get("If-None-Match"), r.Header.Get("If-Modified-Since")
+		if gotETag == `"v1"` || gotSince == "Fri, 12 Dec 2025 08:00:00 GMT" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", "Fri, 12 Dec 2025 08:00:00 GMT")
+		w.Write([]byte(apiBody(page)))
+	}))
+	defer srv.Close()
+	redirect(t, srv)
+	t.Setenv(testFileEnv, "")
+	ctx := context.Background()
+
+	body, v, err := loadContent(ctx, State{})
+	if err != nil || body != page {
+		t.Fatalf("first fetch: %q, %v", body, err)
+	}
+	if gotETag != "" || gotSince != "" {
+		t.Errorf("first fetch sent validators %q, %q", gotETag, gotSince)
+	}
+	if len(v.Pages) != 1 || v.Pages[0].ETag != `"v1"` || v.Pages[0].LastModified == "" {
+		t.Fatalf("validators = %+v", v)
+	}
+	pc := v.Pages[0]
+
+	if _, _, err := loadContent(ctx, State{Pages: v.Pages}); !errors.Is(err, errNotModified) {
+		t.Errorf("ETag fetch err = %v, want errNotModified", err)
+	}
+	if gotETag != `"v1"` || gotSince != "" {
+		t.Errorf("ETag fetch sent %q, %q; want only If-None-Match", gotETag, gotSince)
+	}
+	since := []pageCache{{URL: pc.URL, LastModified: pc.LastModified}}
+	if _, _, err := loadContent(ctx, State{Pages: since}); !errors.Is(err, errNotModified) {
+		t.Errorf("Last-Modified fetch err = %v, want errNotModified", err)
+	}
+	if gotSince != pc.LastModified {
+		t.Errorf("If-Modified-Since = %q, want %q", gotSince, pc.LastModified)
+	}
+}
+
+func TestAcquirePIDFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "powerbot.pid")
+
+	// A live process other than us holds the file.
+	cmd := exec.Command("sleep", "10")
+	if err := cmd.Start(); err != nil {
+		t.Skipf("start helper process: %v", err)
+	}
+	defer func() { cmd.Process.Kill(); cmd.Wait() }()
+	os.WriteFile(path, []byte(strconv.Itoa(cmd.Process.Pid)+"\n"), 0o644)
+	if _, err := acquirePIDFile(path); err == nil || !strings.Contains(err.Error(), "already running") {
+		t.Errorf("live pid: err = %v, want already running", err)
+	}
+
+	// Our own pid, e.g. after a restart in place, is not a conflict.
+	os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644)
+	release, err := acquirePIDFile(path)
+	if err != nil {
+		t.Fatalf("own pid: %v", err)
+	}
+	release()
+
+	// A pid that no longer exists is stale and taken over.
+	cmd.Process.Kill()
+	cmd.Wait()
+	os.WriteFile(path, []byte(strconv.Itoa(cmd.Process.Pid)+"\n"), 0o644)
+	release, err = acquirePIDFile(path)
+	if err != nil {
+		t.Fatalf("stale pid: %v", err)
+	}
+	if b, _ := os.ReadFile(path); strings.TrimSpace(string(b)) != strconv.Itoa(os.Getpid()) {
+		t.Errorf("pid file = %q, want our pid", b)
+	}
+	release()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("pid file left after release: %v", err)
+	}
+}
+
+func TestRunDaemonStartupDelayCancel(t *testing.T) {
+	dir := t.TempDir()
+	statePath := filepath.Join(dir, "state.json")
+	setEnv(t, map[string]string{
+		startupDelayEnv: "1h",
+		statePathEnv:    statePath,
+		testFileEnv:     filepath.Join(dir, "page.html"),
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	runDaemon(ctx, time.Hour)
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("runDaemon took %s after cancellation during the startup delay", d)
+	}
+	if _, err := os.Stat(statePath); !os.IsNotExist(err) {
+		t.Errorf("a cycle ran during the startup delay (state: %v)", err)
+	}
+}
+
+func TestDayNote(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notes.json")
+	t.Setenv(notesFileEnv, path)
+	d := day("2025-12-12", map[string]string{groupPower: "немає з 08:00 до 10:00"})
+	plain := scheduleText(d, "12.12", false, 0, nil, watched)
+
+	os.WriteFile(path, []byte(`{"2025-12-12": " Генератор у холі "}`), 0o644)
+	if got := formatSchedule(d, false, 0, nil, watched); got != plain+"\nГенератор у холі" {
+		t.Errorf("with note:\n%s", got)
+	}
+	os.WriteFile(path, []byte(`{"2025-12-12": "Генератор не працює"}`), 0o644)
+	if got := formatSchedule(d, false, 0, nil, watched); !strings.HasSuffix(got, "\nГенератор не працює") {
+		t.Errorf("edited note:\n%s", got)
+	}
+	// The note is not part of the schedule, so editing it is not an update.
+	if changed, _, _ := compareDay(d, d); changed {
+		t.Error("compareDay reports a change for the same schedule")
+	}
+	if got := formatSchedule(day("2025-12-13", nil), false, 0, nil, watched); strings.Contains(got, "Генератор") {
+		t.Errorf("note leaked to another day:\n%s", got)
+	}
+	os.WriteFile(path, []byte("{"), 0o644)
+	if got := formatSchedule(d, false, 0, nil, watched); got != plain {
+		t.Errorf("broken notes file:\n%s", got)
+	}
+}
+
+// pipeServer runs serve on the far end of an in-memory connection and returns
+// the near end. What serve hands to got is what the client sent.
+func pipeServer(t *testing.T, serve func(r *bufio.Reader, w net.Conn, got *strings.Builder)) (net.Conn, <-chan string) {
+	t.Helper()
+	client, server := net.Pipe()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	server.SetDeadline(time.Now().Add(5 * time.Second))
+	sent := make(chan string, 1)
+	go func() {
+		defer server.Close()
+		var got strings.Builder
+		serve(bufio.NewReader(server), server, &got)
+		sent <- got.String()
+	}()
+	t.Cleanup(func() { client.Close() })
+	return client, sent
+}
+
+func TestNatsPublish(t *testing.T) {
+	payload := []byte(`{"a":1}`)
+	tests := []struct {
+		name     string
+		user     *url.Userinfo
+		greeting string
+		reply    string // after the PING; empty closes the connection
+		closeNow bool   // close right after the greeting
+		want     string
+		wantErr  string
+	}{
+		{
+			name:     "publish",
+			greeting: "INFO {}\r\n",
+			reply:    "PONG\r\n",
+			want:     "CONNECT {\"name\":\"powerbot\",\"pedantic\":false,\"verbose\":false}\r\nPUB sched 7\r\n{\"a\":1}\r\nPING\r\n",
+		},
+		{
+			name:     "credentials",
+			user:     url.UserPassword("bot", "pw"),
+			greeting: "INFO {}\r\n",
+			reply:    "PONG\r\n",
+			want:     "CONNECT {\"name\":\"powerbot\",\"pass\":\"pw\",\"pedantic\":false,\"user\":\"bot\",\"verbose\":false}\r\nPUB sched 7\r\n{\"a\":1}\r\nPING\r\n",
+		},
+		{
+			name:     "server error",
+			greeting: "INFO {}\r\n",
+			reply:    "-ERR 'Authorization Violation'\r\n",
+			wantErr:  "-ERR 'Authorization Violation'",
+		},
+		{
+			name:     "bad greeting",
+			greeting: "HELLO\r\n",
+			wantErr:  `unexpected greeting "HELLO"`,
+		},
+		{
+			name:     "closed before PONG",
+			greeting: "INFO {}\r\n",
+			wantErr:  "EOF",
+		},
+		{
+			name:     "closed before CONNECT",
+			greeting: "INFO {}\r\n",
+			closeNow: true,
+			wantErr:  io.ErrClosedPipe.Error(),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, sent := pipeServer(t, func(r *bufio.Reader, w net.Conn, got *strings.Builder) {
+				w.Write([]byte(tt.greeting))
+				if tt.closeNow || !strings.HasPrefix(tt.greeting, "INFO") {
+					return
+				}
+				for {
+					line, err := r.ReadString('\n')
+					got.WriteString(line)
+					if err != nil || line == "PING\r\n" {
+						break
+					}
+				}
+				if tt.reply != "" {
+					w.Write([]byte(tt.reply))
+				}
+			})
+			err := natsPublish(conn, tt.user, "sched", payload)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("err = %v", err)
+			}
+			if got := <-sent; got != tt.want {
+				t.Errorf("sent\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+// readRESP reads one RESP array command from r, returning it as sent.
+func readRESP(r *bufio.Reader) (string, error) {
+	head, err := r.ReadString('\n')
+	if err != nil {
+		return head, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(head, "*")))
+	if err != nil {
+		return head, err
+	}
+	out := head
+	for i := 0; i < 2*n; i++ {
+		line, err := r.ReadString('\n')
+		out += line
+		if err != nil {
+			return out, err
+		}
+	}
+	return out, nil
+}
+
+func TestRedisPush(t *testing.T) {
+	payload := []byte(`{"a":1}`)
+	rpush := "*3\r\n$5\r\nRPUSH\r\n$5\r\nsched\r\n$7\r\n{\"a\":1}\r\n"
+	tests := []struct {
+		name    string
+		user    *url.Userinfo
+		replies []string // one per command; the connection closes after them
+		want    string
+		wantErr string
+	}{
+		{name: "push", replies: []string{":1\r\n"}, want: rpush},
+		{
+			name:    "password only",
+			user:    url.UserPassword("", "pw"),
+			replies: []string{"+OK\r\n", ":1\r\n"},
+			want:    "*2\r\n$4\r\nAUTH\r\n$2\r\npw\r\n" + rpush,
+		},
+		{
+			name:    "password as user",
+			user:    url.User("pw"),
+			replies: []string{"+OK\r\n", ":1\r\n"},
+			want:    "*2\r\n$4\r\nAUTH\r\n$2\r\npw\r\n" + rpush,
+		},
+		{
+			name:    "user and password",
+			user:    url.UserPassword("bot", "pw"),
+			replies: []string{"+OK\r\n", ":1\r\n"},
+			want:    "*3\r\n$4\r\nAUTH\r\n$3\r\nbot\r\n$2\r\npw\r\n" + rpush,
+		},
+		{
+			name:    "auth rejected",
+			user:    url.UserPassword("", "bad"),
+			replies: []string{"-WRONGPASS invalid username-password pair\r\n"},
+			want:    "*2\r\n$4\r\nAUTH\r\n$3\r\nbad\r\n",
+			wantErr: "WRONGPASS invalid username-password pair",
+		},
+		{name: "push rejected", replies: []string{"-WRONGTYPE not a list\r\n"}, want: rpush, wantErr: "WRONGTYPE not a list"},
+		{name: "closed", wantErr: io.ErrClosedPipe.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, sent := pipeServer(t, func(r *bufio.Reader, w net.Conn, got *strings.Builder) {
+				for _, reply := range tt.replies {
+					cmd, err := readRESP(r)
+					got.WriteString(cmd)
+					if err != nil {
+						return
+					}
+					w.Write([]byte(reply))
+				}
+			})
+			err := redisPush(conn, tt.user, "sched", payload)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("err = %v", err)
+			}
+			if tt.want == "" {
+				return
+			}
+			if got := <-sent; got != tt.want {
+				t.Errorf("sent\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueueNotifierRedis(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("no local listener: %v", err)
+	}
+	defer ln.Close()
+	sent := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		cmd, _ := readRESP(bufio.NewReader(conn))
+		conn.Write([]byte(":1\r\n"))
+		sent <- cmd
+	}()
+	u, _ := url.Parse("redis://" + ln.Addr().String() + "/powerbot")
+	q := queueNotifier{u: u, chatID: "-100"}
+	day := DayInfo{Date: "2025-12-12", Groups: map[string]GroupInfo{groupPower: {Text: "з 08:00 до 12:00", Minutes: 240}}}
+	if err := q.Notify(context.Background(), day, "*графік*"); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	lines := strings.Split(<-sent, "\r\n")
+	if len(lines) < 7 || lines[2] != "RPUSH" || lines[4] != "powerbot" {
+		t.Fatalf("unexpected command %q", lines)
+	}
+	var msg queueMessage
+	if err := json.Unmarshal([]byte(lines[6]), &msg); err != nil {
+		t.Fatalf("payload: %v", err)
+	}
+	if msg.Chat != "-100" || msg.Text != "*графік*" || msg.Date != "2025-12-12" || msg.Groups[groupPower].Minutes != 240 {
+		t.Errorf("payload = %+v", msg)
+	}
+}
+
+func TestGithubNotifier(t *testing.T) {
+	const path = "/repos/me/archive/contents/schedules/2025-12-12.json"
+	var sha string
+	var puts []map[string]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path {
+			t.Errorf("%s %s, want %s", r.Method, r.URL.Path, path)
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer tok" {
+			t.Errorf("Authorization = %q", got)
+		}
+		switch r.Method {
+		case http.MethodGet:
+			if sha == "" {
+				http.NotFound(w, r)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"sha": sha})
+		case http.MethodPut:
+			b, _ := io.ReadAll(r.Body)
+			var body map[string]string
+			if err := json.Unmarshal(b, &body); err != nil {
+				t.Errorf("PUT body %q: %v", b, err)
+			}
+			puts = append(puts, body)
+			sha = "abc123"
+			w.WriteHeader(http.StatusCreated)
+		default:
+			t.Errorf("unexpected %s", r.Method)
+		}
+	}))
+	defer srv.Close()
+
+	g := githubNotifier{api: srv.URL, token: "tok", repo: "me/archive", path: defaultGithubPath}
+	d := day("2025-12-12", map[string]string{groupPower: "немає з 08:00 до 12:00"})
+	for i := 0; i < 2; i++ {
+		if err := g.Notify(context.Background(), d, "ignored"); err != nil {
+			t.Fatalf("Notify %d: %v", i, err)
+		}
+	}
+	if len(puts) != 2 {
+		t.Fatalf("got %d PUTs, want 2", len(puts))
+	}
+	if puts[0]["sha"] != "" || puts[1]["sha"] != "abc123" {
+		t.Errorf("sha = %q then %q, want none then abc123", puts[0]["sha"], puts[1]["sha"])
+	}
+	if puts[0]["message"] != "графік на 12.12" {
+		t.Errorf("message = %q", puts[0]["message"])
+	}
+	raw, err := base64.StdEncoding.DecodeString(puts[0]["content"])
+	if err != nil {
+		t.Fatalf("content is not base64: %v", err)
+	}
+	var got DayInfo
+	if err := json.Unmarshal(raw, &got); err != nil || got.Date != d.Date || got.Groups[groupPower] != d.Groups[groupPower] {
+		t.Errorf("content = %s (%v)", raw, err)
+	}
+}
+
+func TestWeekCommand(t *testing.T) {
+	st := State{Days: []DayInfo{
+		day("2025-12-13", map[string]string{groupPower: "немає з 08:00 до 12:00", groupWater: "немає з 08:00 до 09:30"}),
+		day("2025-12-11", map[string]string{groupPower: "немає з 08:00 до 10:00"}),
+		day("2025-12-12", map[string]string{groupPower: "немає з 00:00 до 24:00", groupWater: "немає з 12:00 до 18:00"}),
+	}}
+	now := time.Date(2025, 12, 12, 9, 0, 0, 0, time.UTC)
+	_, reply, changed := handleCommand(st, "42", "/week", now)
+	want := "11\\.12: 💡2ч 💧н/д\n12\\.12: 💡24ч 💧6ч\n13\\.12: 💡4ч 💧1\\.5ч"
+	if reply != want || changed {
+		t.Errorf("/week = %q, %v; want %q", reply, changed, want)
+	}
+
+	st.Subscriptions = map[string][]string{"42": {groupWater}}
+	if _, reply, _ := handleCommand(st, "42", "/week", now); reply != "11\\.12: 💧н/д\n12\\.12: 💧6ч\n13\\.12: 💧1\\.5ч" {
+		t.Errorf("subscribed /week = %q", reply)
+	}
+	if _, reply, _ := handleCommand(State{}, "42", "/week", now); reply != "збережених графіків немає" {
+		t.Errorf("empty /week = %q", reply)
+	}
+}
+
+func TestLoadGroups(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"power,water", []string{groupPower, groupWater}},
+		{" Water ", []string{groupWater}},
+		{"3.2, Група  3.2,power, 6.1", []string{"Група 3.2", groupPower}},
+		{"12.1,x.y,3", []string{"Група 12.1"}},
+		{"nope", []string{groupPower, groupWater}},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, g := range loadGroups(tt.in) {
+			got = append(got, g.Name)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("loadGroups(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+	if g := loadGroups("3.2")[0]; g.Label != "*💡 Група 3\\.2*" || g.Emoji != emojiPower {
+		t.Errorf("loadGroups(3.2) = %+v", g)
+	}
+}
+
+func TestRunDryRun(t *testing.T) {
+	posts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posts++
+	}))
+	defer srv.Close()
+	redirect(t, srv)
+
+	loc, _ := time.LoadLocation(kyivTZ)
+	today := time.Now().In(loc).Format("02.01.2006")
+	dir := t.TempDir()
+	pagePath := filepath.Join(dir, "page.html")
+	os.WriteFile(pagePath, []byte(`<p><b>Графік погодинних відключень на `+today+`</b></p>`+
+		`<p>Група 6.1. Електроенергії немає з 08:00 до 12:00.</p>`), 0o644)
+	statePath := filepath.Join(dir, "state.json")
+	setEnv(t, map[string]string{
+		testFileEnv:        pagePath,
+		statePathEnv:       statePath,
+		tokenEnv:           "TOKEN",
+		chatIDEnv:          "42",
+		criticalWebhookEnv: srv.URL,
+		criticalMinutesEnv: "60",
+	})
+	defer func() { dryRun, dryRunNoSave = false, false }()
+	dryRun, dryRunNoSave = true, true
+
+	r, w, _ := os.Pipe()
+	stdout := os.Stdout
+	os.Stdout = w
+	err := run(context.Background())
+	os.Stdout = stdout
+	w.Close()
+	out, _ := io.ReadAll(r)
+
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if posts != 0 {
+		t.Errorf("dry run made %d HTTP calls", posts)
+	}
+	if want := "--- post " + today[:5] + " ---\n*графік на " + escapeMarkdownV2(today[:5]) + "*\n"; !strings.HasPrefix(string(out), want) {
+		t.Errorf("stdout = %q, want prefix %q", out, want)
+	}
+	if _, err := os.Stat(statePath); !os.IsNotExist(err) {
+		t.Errorf("state written with no-save: %v", err)
+	}
+}
+
+func TestHeadersWithoutSchedule(t *testing.T) {
+	now := time.Date(2025, 12, 12, 9, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		body string
+		want bool
+	}{
+		{"garbage", "<p>оновлюємо сторінку…</p>", false},
+		{"headers only", `<p><b>Графік погодинних відключень на 12.12.2025</b></p><p>Інформація з'явиться згодом.</p>`, true},
+		{"valid", page, false},
+	}
+	for _, tt := range tests {
+		if got := headersWithoutSchedule(tt.body, now); got != tt.want {
+			t.Errorf("%s: headersWithoutSchedule = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRunRefetchOnEmpty(t *testing.T) {
+	loc, _ := time.LoadLocation(kyivTZ)
+	today := time.Now().In(loc).Format("02.01.2006")
+	header := `<p><b>Графік погодинних відключень на ` + today + `</b></p>`
+	bodies := []string{
+		header + `<p>Інформація з'явиться згодом.</p>`,
+		header + `<p>Група 6.1. Електроенергії немає з 08:00 до 12:00.</p>`,
+	}
+	fetches, posts := 0, 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/bot") {
+			posts++
+			w.Write([]byte(`{"ok":true,"result":{"message_id":1}}`))
+			return
+		}
+		w.Write([]byte(apiBody(bodies[min(fetches, len(bodies)-1)])))
+		fetches++
+	}))
+	defer srv.Close()
+	redirect(t, srv)
+	setEnv(t, map[string]string{
+		testFileEnv:  "",
+		statePathEnv: filepath.Join(t.TempDir(), "state.json"),
+		tokenEnv:     "TOKEN",
+		chatIDEnv:    "42",
+		refetchEnv:   "1",
+	})
+
+	// The first fetch has the header but no groups yet; the re-fetch has them.
+	if err := run(context.Background()); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if fetches != 2 || posts != 1 {
+		t.Errorf("%d fetches, %d posts; want the re-fetch posted", fetches, posts)
+	}
+}
+
+func TestSendTelegramRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		wantErr  bool
+		calls    int
+		minWait  time.Duration
+	}{
+		{name: "429 then ok", statuses: []int{http.StatusTooManyRequests, http.StatusOK}, calls: 2, minWait: time.Second},
+		{name: "bad request", statuses: []int{http.StatusBadRequest}, wantErr: true, calls: 1},
+		{name: "keeps failing", statuses: []int{http.StatusBadGateway, http.StatusBadGateway}, wantErr: true, calls: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/botTOKEN/sendMessage" {
+					t.Errorf("path = %s", r.URL.Path)
+				}
+				status := tt.statuses[min(calls, len(tt.statuses)-1)]
+				calls++
+				w.WriteHeader(status)
+				if status == http.StatusTooManyRequests {
+					w.Write([]byte(`{"ok":false,"error_code":429,"parameters":{"retry_after":1}}`))
+				}
+			}))
+			defer srv.Close()
+			redirect(t, srv)
+			t.Setenv(telegramRetriesEnv, "2")
+			start := time.Now()
+			err := sendTelegram(context.Background(), "TOKEN", "42", "", "hi")
+			if (err != nil) != tt.wantErr || calls != tt.calls {
+				t.Errorf("err = %v after %d calls; want error %v after %d", err, calls, tt.wantErr, tt.calls)
+			}
+			if d := time.Since(start); d < tt.minWait {
+				t.Errorf("returned after %s, before retry_after", d)
+			}
+		})
+	}
+}
+
+func TestRunCorrection(t *testing.T) {
+	var sent []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/botTOKEN/sendMessage" {
+			t.Errorf("path = %s", r.URL.Path)
+		}
+		sent = append(sent, telegramPayload(t, r)["text"])
+	}))
+	defer srv.Close()
+	redirect(t, srv)
+	dir := t.TempDir()
+	pagePath := filepath.Join(dir, "page.html")
+	os.WriteFile(pagePath, []byte(page), 0o644)
+	statePath := filepath.Join(dir, "state.json")
+	setEnv(t, map[string]string{testFileEnv: pagePath, statePathEnv: statePath, tokenEnv: "TOKEN", chatIDEnv: "42"})
+
+	if err := runCorrection(context.Background(), "12.12.2025"); err != nil {
+		t.Fatalf("runCorrection: %v", err)
+	}
+	if len(sent) != 1 || !strings.HasPrefix(sent[0], "*✏️ виправлення графіка на 12\\.12*\n*💡 світла не буде*: ") {
+		t.Errorf("sent %q", sent)
+	}
+	st, err := loadState(statePath)
+	if err != nil || len(st.Days) != 1 || st.Days[0].Date != "2025-12-12" {
+		t.Errorf("state after correction: %+v, %v", st, err)
+	}
+	if err := runCorrection(context.Background(), "2025-12-20"); err == nil || len(sent) != 1 {
+		t.Errorf("day missing from the page: err %v, %d posts", err, len(sent))
+	}
+	if err := runCorrection(context.Background(), "20/12"); err == nil {
+		t.Error("bad date accepted")
+	}
+}
+
+func TestChatTokens(t *testing.T) {
+	var sent []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := telegramPayload(t, r)
+		sent = append(sent, r.URL.Path+" "+p["chat_id"]+" "+p["message_thread_id"])
+	}))
+	defer srv.Close()
+	redirect(t, srv)
+	setEnv(t, map[string]string{tokenEnv: "GLOBAL", chatTokensEnv: " -200 = OTHER/7, junk"})
+
+	for _, chat := range []string{"-100", "-200"} {
+		n, ok := newTelegramNotifier(chat)
+		if !ok {
+			t.Fatalf("no notifier for %s", chat)
+		}
+		if err := n.Notify(context.Background(), DayInfo{Date: "2025-12-12"}, "hi"); err != nil {
+			t.Fatalf("Notify %s: %v", chat, err)
+		}
+	}
+	want := []string{"/botGLOBAL/sendMessage -100 ", "/botOTHER/sendMessage -200 7"}
+	if len(sent) != 2 || sent[0] != want[0] || sent[1] != want[1] {
+		t.Errorf("sent %q, want %q", sent, want)
+	}
+
+	t.Setenv(tokenEnv, "")
+	if _, ok := newTelegramNotifier("-100"); ok {
+		t.Error("notifier without any token")
+	}
+	if n, ok := newTelegramNotifier("-200"); !ok || n.token != "OTHER" {
+		t.Errorf("per-chat token without a global one: %+v, %v", n, ok)
+	}
+}
+
+func TestCheckFresh(t *testing.T) {
+	noon := func(day int) time.Time { return time.Date(2025, 12, day, 10, 0, 0, 0, time.UTC) }
+	if err := checkFresh(page, noon(13)); err != nil {
+		t.Errorf("checkFresh on the day of the newest header: %v", err)
+	}
+	if err := checkFresh(page, noon(14)); err == nil {
+		t.Error("checkFresh passed a feed whose newest header is yesterday")
+	}
+}
+
+func TestParsePageSkipsBadDay(t *testing.T) {
+	// A garbled 12.12 section followed by the good 13.12 one.
+	bad := `<b>Графік погодинних відключень на 12.12.2025</b><p>Група 6.1. Електроенергії немає з 25:00 до 26:00.</p>`
+	body := bad + page[strings.Index(page, "<p><b>Графік погодинних відключень на 13.12.2025"):]
+	d12 := time.Date(2025, 12, 12, 0, 0, 0, 0, time.UTC)
+	days, _, err := parsePage(body, []time.Time{d12, d12.AddDate(0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(days) != 1 || days[0].Date != "2025-12-13" {
+		t.Errorf("parsed %+v, want only 2025-12-13", days)
+	}
+}
+
+func TestParsePageSpacing(t *testing.T) {
+	// The editor's spacing must not change what parsePage finds.
+	spaced := strings.NewReplacer("Група 6.1.", "Група&nbsp;6.1.", "немає з", "немає  з", "на 13", "на\n13").Replace(page)
+	d12 := time.Date(2025, 12, 12, 0, 0, 0, 0, time.UTC)
+	dates := []time.Time{d12, d12.AddDate(0, 0, 1)}
+	want, _, err := parsePage(page, dates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _, err := parsePage(spaced, dates)
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("spaced page parsed %+v, %v; want %+v", got, err, want)
+	}
+}
+
+func TestParsePageLineBreaks(t *testing.T) {
+	// Sentences ended by line breaks and semicolons instead of periods.
+	body := "<b>Графік погодинних відключень на 12.12.2025</b>\n" +
+		"Група 6.1\n  Електроенергії немає з 08:00 до 12:00\n" +
+		"Група 4.1; Електроенергії немає з 10:00 до 11:00;\n"
+	d12 := time.Date(2025, 12, 12, 0, 0, 0, 0, time.UTC)
+	days, _, err := parsePage(body, []time.Time{d12})
+	if err != nil || len(days) != 1 {
+		t.Fatalf("parsePage = %+v, %v", days, err)
+	}
+	want := map[string]string{
+		groupPower: "Електроенергії немає з 08:00 до 12:00",
+		groupWater: "Електроенергії немає з 10:00 до 11:00",
+	}
+	for g, text := range want {
+		if got := days[0].Groups[g].Text; got != text {
+			t.Errorf("%s = %q, want %q", g, got, text)
+		}
+	}
+}
+
+func TestCountdownText(t *testing.T) {
+	kyiv, err := time.LoadLocation(kyivTZ)
+	if err != nil {
+		t.Skip(err)
+	}
+	st := State{Days: []DayInfo{day("2025-12-12", map[string]string{groupPower: "немає з 10:00 до 12:00"})}}
+	at := func(h, m int) time.Time { return time.Date(2025, 12, 12, h, m, 0, 0, kyiv) }
+	tests := []struct {
+		now  time.Time
+		want string
+	}{
+		{at(9, 0), "*⏳ 12\\.12*\n💡 до вимкнення: 1 год\n💧 н/д"},
+		{at(10, 0), "*⏳ 12\\.12*\n💡 до ввімкнення: 2 год\n💧 н/д"},
+		{at(11, 45), "*⏳ 12\\.12*\n💡 до ввімкнення: 15 хв\n💧 н/д"},
+		{at(12, 0), "*⏳ 12\\.12*\n💡 сьогодні більше без вимкнень\n💧 н/д"},
+		{at(12, 0).AddDate(0, 0, 1), "⏳ графіка на сьогодні ще немає"},
+	}
+	for _, tt := range tests {
+		if got := countdownText(st, tt.now); got != tt.want {
+			t.Errorf("at %s:\n%s\nwant\n%s", tt.now.Format("15:04"), got, tt.want)
+		}
+	}
+}
+
+func TestUpdatePin(t *testing.T) {
+	kyiv, err := time.LoadLocation(kyivTZ)
+	if err != nil {
+		t.Skip(err)
+	}
+	var calls []string
+	editErr := ""
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method := strings.TrimPrefix(r.URL.Path, "/botTOKEN/")
+		calls = append(calls, method+" "+telegramPayload(t, r)["message_id"])
+		switch {
+		case method == "editMessageText" && editErr != "":
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"ok":false,"description":"Bad Request: ` + editErr + `"}`))
+		case method == "sendMessage":
+			w.Write([]byte(`{"ok":true,"result":{"message_id":77}}`))
+		default:
+			w.Write([]byte(`{"ok":true,"result":true}`))
+		}
+	}))
+	defer srv.Close()
+	redirect(t, srv)
+	setEnv(t, map[string]string{tokenEnv: "TOKEN", chatIDEnv: "-100"})
+	ctx := context.Background()
+	st := State{Days: []DayInfo{day("2025-12-12", map[string]string{groupPower: "немає з 10:00 до 12:00"})}}
+	at := func(h, m int) time.Time { return time.Date(2025, 12, 12, h, m, 0, 0, kyiv) }
+
+	steps := []struct {
+		name  string
+		now   time.Time
+		calls string
+	}{
+		{"first run posts and pins", at(9, 0), "sendMessage  pinChatMessage 77"},
+		{"same text, nothing sent", at(9, 0), ""},
+		{"outage starts, edited", at(10, 0), "editMessageText 77"},
+		{"a minute later, edited", at(10, 1), "editMessageText 77"},
+	}
+	for _, s := range steps {
+		calls = nil
+		st = updatePin(ctx, st, s.now)
+		if got := strings.Join(calls, " "); got != s.calls {
+			t.Errorf("%s: calls %q, want %q", s.name, got, s.calls)
+		}
+		if st.Pin == nil || st.Pin.MessageID != 77 || st.Pin.Text != countdownText(st, s.now) {
+			t.Errorf("%s: pin = %+v", s.name, st.Pin)
+		}
+	}
+
+	// Any other 400 leaves the pin alone rather than posting a second one.
+	editErr = "can't parse entities"
+	calls = nil
+	st = updatePin(ctx, st, at(11, 0))
+	if got := strings.Join(calls, " "); got != "editMessageText 77" {
+		t.Errorf("failed edit: calls %q", got)
+	}
+
+	editErr = "message to edit not found"
+	calls = nil
+	st = updatePin(ctx, st, at(12, 0))
+	if got := strings.Join(calls, " "); got != "editMessageText 77 sendMessage  pinChatMessage 77" {
+		t.Errorf("deleted pin: calls %q", got)
+	}
+}
+
+func TestParsePageConcurrency(t *testing.T) {
+	d11 := time.Date(2025, 12, 11, 0, 0, 0, 0, time.UTC)
+	var dates []time.Time
+	for i := 0; i < 5; i++ {
+		dates = append(dates, d11.AddDate(0, 0, i))
+	}
+	want, _, err := parsePage(page, dates)
+	if err != nil || len(want) != 2 {
+		t.Fatalf("sequential parse: %+v, %v", want, err)
+	}
+	for _, n := range []string{"2", "8", "x"} {
+		t.Setenv(parseConcurrencyEnv, n)
+		got, _, err := parsePage(page, dates)
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("%s=%s: %+v, %v; want %+v", parseConcurrencyEnv, n, got, err, want)
+		}
+	}
+}
+
+func TestPostDigest(t *testing.T) {
+	kyiv, err := time.LoadLocation(kyivTZ)
+	if err != nil {
+		t.Skip(err)
+	}
+	// The digest reads the stored days, so it goes out on a cycle whose page
+	// did not change just the same.
+	stored := State{Days: []DayInfo{
+		day("2025-12-12", map[string]string{groupPower: "немає з 10:00 до 12:00"}),
+		day("2025-12-13", map[string]string{groupPower: "немає з 14:00 до 16:00"}),
+		day("2025-12-14", map[string]string{groupPower: "немає з 08:00 до 09:00"}),
+	}}
+	rec := &recorder{}
+	notifiers := []Notifier{recordingNotifier{r: rec, kind: "post"}}
+	at := func(d, h, m int) time.Time { return time.Date(2025, 12, d, h, m, 0, 0, kyiv) }
+	ctx := context.Background()
+
+	st, err := postDigest(ctx, at(12, 6, 59), 7*time.Hour, stored, nil, notifiers)
+	if err != nil || len(rec.posts) != 0 || st.LastDigest != "" {
+		t.Fatalf("before the hour: %d posts, %+v, %v", len(rec.posts), st, err)
+	}
+	// 13.12 was just posted as new, so only today is repeated.
+	st, err = postDigest(ctx, at(12, 7, 0), 7*time.Hour, st, map[string]bool{"2025-12-13": true}, notifiers)
+	if err != nil || len(rec.posts) != 1 || rec.posts[0].Date != "2025-12-12" || st.LastDigest != "2025-12-12" {
+		t.Fatalf("at the hour: posts %+v, %+v, %v", rec.posts, st, err)
+	}
+	if st, _ = postDigest(ctx, at(12, 21, 0), 7*time.Hour, st, nil, notifiers); len(rec.posts) != 1 {
+		t.Errorf("second digest the same day: %d posts", len(rec.posts))
+	}
+	rec.posts = nil
+	if st, _ = postDigest(ctx, at(13, 7, 30), 7*time.Hour, st, nil, notifiers); len(rec.posts) != 2 || st.LastDigest != "2025-12-13" {
+		t.Errorf("next day: posts %+v, last %s", rec.posts, st.LastDigest)
+	}
+}
+
+func TestStatusCommand(t *testing.T) {
+	st := State{Days: []DayInfo{
+		day("2025-12-13", map[string]string{groupPower: "немає з 08:00 до 12:00"}),
+		day("2025-12-11", map[string]string{groupPower: "немає з 08:00 до 10:00"}),
+		day("2025-12-12", map[string]string{groupPower: "немає з 10:00 до 11:00", groupWater: "немає з 12:00 до 18:00"}),
+	}}
+	now := time.Date(2025, 12, 12, 9, 0, 0, 0, time.UTC)
+	want := "*графік на 12\\.12*\n*💡 світла не буде*: немає з 10:00 до 11:00\n*💧 води не буде*: немає з 12:00 до 18:00\n\n" +
+		"*графік на 13\\.12*\n*💡 світла не буде*: немає з 08:00 до 12:00\n*💧 води не буде*: н/д"
+	if _, reply, _ := handleCommand(st, "42", "/status", now); reply != want {
+		t.Errorf("/status =\n%s\nwant\n%s", reply, want)
+	}
+	if _, reply, _ := handleCommand(st, "42", "/status", now.AddDate(0, 0, 2)); reply != "актуальних графіків немає" {
+		t.Errorf("/status with only past days = %q", reply)
+	}
+}
+
+func TestWriteLastError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "last-error")
+	now := time.Date(2025, 12, 12, 9, 0, 0, 0, time.UTC)
+	writeLastError(path, errors.New("fetch: status 502"), now)
+	if b, err := os.ReadFile(path); err != nil || string(b) != "2025-12-12T09:00:00Z fetch: status 502\n" {
+		t.Errorf("after a failure: %q, %v", b, err)
+	}
+	writeLastError(path, nil, now)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("file left after a success: %v", err)
+	}
+	writeLastError(path, nil, now) // nothing to remove is fine
+}
+
+func TestUpdateEmoji(t *testing.T) {
+	tests := []struct {
+		severe string
+		worse  int
+		want   string
+	}{
+		{"", -1, "🆕"},
+		{"", 0, "🍾"},
+		{"", 59, "😕"},
+		{"", 60, "😩"},
+		{"120", 60, "😕"},
+		{"x", 60, "😩"},
+	}
+	for _, tt := range tests {
+		t.Setenv(severeMinutesEnv, tt.severe)
+		if got := updateEmoji(tt.worse); got != tt.want {
+			t.Errorf("%s=%q, worse %d: %s, want %s", severeMinutesEnv, tt.severe, tt.worse, got, tt.want)
+		}
+	}
+}
+
+func TestMessageTemplate(t *testing.T) {
+	defer func() { messageTmpl = nil }()
+	t.Setenv(messageTemplateEnv, `{{if .Update}}upd {{.Emoji}} {{end}}{{.DM}}{{range .Lines}} {{.Emoji}}{{if .Found}}{{.Minutes}}{{else}}{{.Text}}{{end}}{{end}}`)
+	tmpl, err := loadMessageTemplate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	messageTmpl = tmpl
+	d := day("2025-12-12", map[string]string{groupPower: "немає з 08:00 до 12:00"})
+	if got := scheduleText(d, "12.12", false, 0, nil, watched); got != "12\\.12 💡240 💧н/д" {
+		t.Errorf("new post = %q", got)
+	}
+	if got := scheduleText(d, "12.12", true, 90, nil, watched); got != "upd 😩 12\\.12 💡240 💧н/д" {
+		t.Errorf("update = %q", got)
+	}
+
+	for _, bad := range []string{"{{.DM", "{{.Nope}}", "{{range .Lines}}{{.Missing}}{{end}}"} {
+		t.Setenv(messageTemplateEnv, bad)
+		if _, err := loadMessageTemplate(); err == nil {
+			t.Errorf("template %q accepted", bad)
+		}
+	}
+	t.Setenv(messageTemplateEnv, " ")
+	if tmpl, err := loadMessageTemplate(); tmpl != nil || err != nil {
+		t.Errorf("blank template = %v, %v; want the built-in format", tmpl, err)
+	}
+}
+
+func TestDecodeRawHTML(t *testing.T) {
+	tests := []struct {
+		in, want string
+		fixed    bool
+	}{
+		{in: "<b>Група 6.1</b>&nbsp;", want: "<b>Група 6.1</b>&nbsp;"},
+		{in: "&lt;b&gt;Група&lt;/b&gt;", want: "<b>Група</b>", fixed: true},
+		{in: "&amp;lt;b&amp;gt;", want: "<b>", fixed: true},
+		{in: "<p>Група&amp;nbsp;6.1</p>", want: "<p>Група&nbsp;6.1</p>", fixed: true},
+		{in: `\u003cp\u003eГрупа 6.1\u003c/p\u003e`, want: "<p>Група 6.1</p>", fixed: true},
+	}
+	for _, tt := range tests {
+		if got, fixed := decodeRawHTML(tt.in); got != tt.want || fixed != tt.fixed {
+			t.Errorf("decodeRawHTML(%q) = %q, %v; want %q, %v", tt.in, got, fixed, tt.want, tt.fixed)
+		}
+	}
+}
+
+func TestDigestAt(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		at   time.Duration
+		hold bool
+	}{
+		{name: "unset", at: -1},
+		{name: "digest at", env: map[string]string{digestAtEnv: "07:30"}, at: 7*time.Hour + 30*time.Minute, hold: true},
+		{name: "daily digest", env: map[string]string{dailyDigestEnv: "8"}, at: 8 * time.Hour},
+		{name: "digest at wins", env: map[string]string{digestAtEnv: "07:30", dailyDigestEnv: "8"}, at: 7*time.Hour + 30*time.Minute, hold: true},
+		{name: "invalid digest at", env: map[string]string{digestAtEnv: "7h", dailyDigestEnv: "8"}, at: 8 * time.Hour},
+		{name: "invalid hour", env: map[string]string{dailyDigestEnv: "24"}, at: -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setEnv(t, map[string]string{digestAtEnv: "", dailyDigestEnv: ""})
+			setEnv(t, tt.env)
+			if at, hold := digestAt(); at != tt.at || hold != tt.hold {
+				t.Errorf("digestAt = %v, %v; want %v, %v", at, hold, tt.at, tt.hold)
+			}
+		})
+	}
+}
+
+func TestDigestAtHoldsPosts(t *testing.T) {
+	kyiv, err := time.LoadLocation(kyivTZ)
+	if err != nil {
+		t.Skip(err)
+	}
+	t.Setenv(digestAtEnv, "07:30")
+	rec := &recorder{}
+	notifiers := []Notifier{recordingNotifier{r: rec, kind: "post"}}
+	at := func(h, m int) time.Time { return time.Date(2025, 12, 12, h, m, 0, 0, kyiv) }
+	ctx := context.Background()
+	// cycle is one run: the page when it changed, then the upkeep.
+	cycle := func(now time.Time, st State, changed bool) (State, error) {
+		posted := map[string]bool{}
+		var err error
+		if changed {
+			if st, _, err = process(ctx, now, page, st, notifiers, nil, nil, posted); err != nil {
+				return st, err
+			}
+		}
+		return periodic(ctx, st, now, posted, notifiers)
+	}
+
+	st, err := cycle(at(6, 0), State{}, true)
+	if err != nil || len(rec.posts) != 0 {
+		t.Fatalf("before the digest: %d posts, %v", len(rec.posts), err)
+	}
+	if len(st.Days) != 2 {
+		t.Errorf("held days not stored: %+v", st.Days)
+	}
+	st, err = cycle(at(7, 29), st, true)
+	if err != nil || len(rec.posts) != 0 {
+		t.Fatalf("a minute before the digest: %d posts, %v", len(rec.posts), err)
+	}
+	// The page has not changed since 06:00; the held days go out anyway.
+	st, err = cycle(at(7, 30), st, false)
+	if err != nil || len(rec.posts) != 2 || rec.posts[0].Date != "2025-12-12" || rec.posts[1].Date != "2025-12-13" {
+		t.Fatalf("at the digest: posts %+v, %v", rec.posts, err)
+	}
+	if _, err = cycle(at(9, 0), st, true); err != nil || len(rec.posts) != 2 {
+		t.Errorf("after the digest: %d posts, %v", len(rec.posts), err)
+	}
+}
+
+func TestEscapeMarkdownV2(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"12.12", "12\\.12"},
+		{"з 08:00 до 12:00 (черга 1)!", "з 08:00 до 12:00 \\(черга 1\\)\\!"},
+		{"a_b*c`d", "a\\_b\\*c\\`d"},
+		{"[x](y) ~>#+-=|{}\\", "\\[x\\]\\(y\\) \\~\\>\\#\\+\\-\\=\\|\\{\\}\\\\"},
+	}
+	for _, tt := range tests {
+		got := escapeMarkdownV2(tt.in)
+		if got != tt.want {
+			t.Errorf("escapeMarkdownV2(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+		if back := plainText(got); back != tt.in {
+			t.Errorf("plainText(%q) = %q, want %q", got, back, tt.in)
+		}
+	}
+	if got := plainText("*upd\\. на 12\\.12*\n_дані_"); got != "upd. на 12.12\nдані" {
+		t.Errorf("plainText = %q", got)
+	}
+	if got := escapeLinkV2(`https://x/a\(b)`); got != `https://x/a\\(b\)` {
+		t.Errorf("escapeLinkV2 = %q", got)
+	}
+}
+
+func TestDisablePreview(t *testing.T) {
+	tests := []struct {
+		env, text string
+		want      bool
+	}{
+		{"", "*графік на 12\\.12*", false},
+		{"", "[джерело](https://poweron.loe.lviv.ua/)", true},
+		{"false", "[джерело](https://poweron.loe.lviv.ua/)", false},
+		{"1", "*графік на 12\\.12*", true},
+		{"x", "*графік на 12\\.12*", false},
+	}
+	for _, tt := range tests {
+		t.Setenv(disablePreviewEnv, tt.env)
+		_, got := messagePayload("42", "", tt.text)["disable_web_page_preview"]
+		if got != tt.want {
+			t.Errorf("%s=%q, %q: preview disabled = %v, want %v", disablePreviewEnv, tt.env, tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestLogKV(t *testing.T) {
+	tests := []struct {
+		name string
+		json bool
+		log  func()
+		want string
+	}{
+		{
+			name: "text",
+			log:  func() { logKV("warn", "state save failed", "attempt", 1, "err", errors.New("disk full")) },
+			want: "warning: state save failed attempt=1 err=\"disk full\"\n",
+		},
+		{
+			name: "text prefix from logf",
+			log:  func() { logf("error: fetch: %v", "timeout") },
+			want: "error: fetch: timeout\n",
+		},
+		{
+			name: "odd fields",
+			log:  func() { logKV("info", "posted", "chat") },
+			want: "posted !BADKEY=chat\n",
+		},
+		{
+			name: "json",
+			json: true,
+			log: func() {
+				logKV("error", "post failed", "chat", "-100", "err", errors.New("<b>"), "delay", 2*time.Second)
+			},
+			want: `"level":"error","msg":"post failed","chat":"-100","err":"<b>","delay":"2s"}` + "\n",
+		},
+		{
+			name: "json level from logf",
+			json: true,
+			log:  func() { logf("debug: found %d", 2) },
+			want: `"level":"debug","msg":"found 2"}` + "\n",
+		},
+	}
+	defer func(saved bool) { jsonLogs = saved }(jsonLogs)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jsonLogs = tt.json
+			got := captureStderr(t, tt.log)
+			if tt.json {
+				var v map[string]any
+				if err := json.Unmarshal([]byte(got), &v); err != nil || !strings.HasPrefix(got, `{"ts":`) {
+					t.Fatalf("not a JSON line: %q (%v)", got, err)
+				}
+				if !strings.HasSuffix(got, tt.want) {
+					t.Errorf("got %q, want suffix %q", got, tt.want)
+				}
+				return
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadStateErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string // "" leaves the file missing
+		want    error
+	}{
+		{name: "missing", want: os.ErrNotExist},
+		{name: "truncated", content: `{"days": [`, want: errStateCorrupt},
+		{name: "empty", content: " \n", want: errStateCorrupt},
+		{name: "newer", content: `{"version": 99}`, want: errStateVersion},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "state.json")
+			if tt.content != "" {
+				os.WriteFile(path, []byte(tt.content), 0o644)
+			}
+			if _, err := loadState(path); !errors.Is(err, tt.want) {
+				t.Fatalf("err = %v, want %v", err, tt.want)
+			}
+			if tt.content == "" {
+				return
+			}
+			// The file stays until a rebuilt state replaces it.
+			if b, _ := os.ReadFile(path); string(b) != tt.content {
+				t.Errorf("state file now %q", b)
+			}
+		})
+	}
+}
+
+func TestKeepCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	os.WriteFile(path, []byte("{"), 0o644)
+	keepCorrupt(path)
+	if b, err := os.ReadFile(path + ".bad"); err != nil || string(b) != "{" {
+		t.Errorf(".bad = %q, %v", b, err)
+	}
+}
+
+func TestReplyThread(t *testing.T) {
+	var replies []string
+	next := 100
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		replies = append(replies, telegramPayload(t, r)["reply_to_message_id"])
+		next++
+		fmt.Fprintf(w, `{"ok":true,"result":{"message_id":%d}}`, next)
+	}))
+	defer srv.Close()
+	redirect(t, srv)
+
+	ids := map[string]int{}
+	n := threadReplies([]Notifier{telegramNotifier{token: "TOKEN", chatID: "-100"}}, ids)[0]
+	for _, date := range []string{"2025-12-12", "2025-12-13", "2025-12-15"} {
+		if err := n.Notify(context.Background(), DayInfo{Date: date}, "text"); err != nil {
+			t.Fatalf("Notify %s: %v", date, err)
+		}
+	}
+	// 13.12 replies to 12.12; 15.12 has no post the day before.
+	if want := []string{"", "101", ""}; !reflect.DeepEqual(replies, want) {
+		t.Errorf("replies to %q, want %q", replies, want)
+	}
+	want := map[string]int{"2025-12-12/-100": 101, "2025-12-13/-100": 102, "2025-12-15/-100": 103}
+	if !reflect.DeepEqual(ids, want) {
+		t.Errorf("ids = %v, want %v", ids, want)
+	}
+}
+
+func TestProxyTransport(t *testing.T) {
+	tests := []struct {
+		raw, want string // want "" expects an error
+	}{
+		{"http://proxy:3128", "http://proxy:3128"},
+		{"socks5://user:pw@127.0.0.1:1080", "socks5://user:pw@127.0.0.1:1080"},
+		{"ftp://proxy:21", ""},
+		{"socks5://", ""},
+		{"proxy:3128", ""},
+	}
+	for _, tt := range tests {
+		tr, err := proxyTransport(newTransport(), tt.raw)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("proxyTransport(%q) accepted", tt.raw)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("proxyTransport(%q): %v", tt.raw, err)
+		}
+		req, _ := http.NewRequest("GET", "https://api.telegram.org/", nil)
+		if u, err := tr.Proxy(req); err != nil || u.String() != tt.want {
+			t.Errorf("proxyTransport(%q) proxies via %v, %v", tt.raw, u, err)
+		}
+	}
+}
+
+// TestScenario replays testdata/scenario.json and compares every post with
+// testdata/scenario.out; -update rewrites the file instead.
+func TestScenario(t *testing.T) {
+	// The expected output is for the defaults; settings from the
+	// environment would change the posts.
+	for _, kv := range os.Environ() {
+		if k, _, _ := strings.Cut(kv, "="); strings.HasPrefix(k, "POWERBOT_") {
+			t.Setenv(k, "")
+		}
+	}
+	var got bytes.Buffer
+	if err := simulate(context.Background(), filepath.Join("testdata", "scenario.json"), &got); err != nil {
+		t.Fatalf("simulate: %v", err)
+	}
+	golden := filepath.Join("testdata", "scenario.out")
+	if *update {
+		if err := os.WriteFile(golden, got.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != string(want) {
+		t.Errorf("scenario output differs from %s (rerun with -update if the change is intended):\n%s", golden, got.String())
+	}
+}
+
+func TestCompareDayAddedGroup(t *testing.T) {
+	old := day("2025-12-12", map[string]string{groupPower: "немає з 08:00 до 12:00"})
+	cur := day("2025-12-12", map[string]string{groupPower: "немає з 08:00 до 12:00", groupWater: "немає з 14:00 до 16:00"})
+	tests := []struct {
+		neutral string
+		worse   int
+	}{
+		{"", 120},
+		{"1", -1},
+	}
+	for _, tt := range tests {
+		t.Setenv(addedNeutralEnv, tt.neutral)
+		if changed, worse, _ := compareDay(old, cur); !changed || worse != tt.worse {
+			t.Errorf("%s=%q: compareDay = %v, %d; want true, %d", addedNeutralEnv, tt.neutral, changed, worse, tt.worse)
+		}
+	}
+}
+
+func TestCombineDays(t *testing.T) {
+	same := map[string]string{groupPower: "немає з 08:00 до 12:00"}
+	days := []DayInfo{
+		day("2025-12-12", same),
+		day("2025-12-13", map[string]string{groupPower: "Електроенергії немає з 8:00 до 12:00."}),
+		day("2025-12-15", same),
+		day("2025-12-16", map[string]string{groupPower: "немає з 09:00 до 12:00"}),
+		day("2025-12-31", same),
+		day("2026-01-01", same),
+	}
+	var got []string
+	for _, run := range combineDays(days) {
+		got = append(got, rangeDM(run))
+	}
+	if want := "12–13.12 15.12 16.12 31.12–01.01"; strings.Join(got, " ") != want {
+		t.Errorf("runs = %q, want %q", got, want)
+	}
+}
+
+func TestLoadContentPages(t *testing.T) {
+	var fetched []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := r.URL.Query().Get("page")
+		fetched = append(fetched, n)
+		i, _ := strconv.Atoi(n)
+		resp := map[string]any{
+			"hydra:member": []any{map[string]any{
+				"menuItems": []any{map[string]string{"rawHtml": "<p>page " + n + "</p>"}},
+			}},
+		}
+		// Page 3 is the last one: it still links itself, as some APIs do.
+		next := "/api/menus?page=" + strconv.Itoa(min(i+1, 3)) + "&type=photo-grafic"
+		resp["hydra:view"] = map[string]string{"hydra:next": next}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer srv.Close()
+	redirect(t, srv)
+	t.Setenv(testFileEnv, "")
+
+	tests := []struct {
+		maxPages string
+		want     string
+		fetched  string
+	}{
+		{"", "<p>page 1</p>\n<p>page 2</p>\n<p>page 3</p>", "1 2 3"},
+		{"2", "<p>page 1</p>\n<p>page 2</p>", "1 2"},
+	}
+	for _, tt := range tests {
+		t.Setenv(maxPagesEnv, tt.maxPages)
+		fetched = nil
+		body, _, err := loadContent(context.Background(), State{})
+		if err != nil || body != tt.want {
+			t.Errorf("%s=%q: loadContent = %q, %v; want %q", maxPagesEnv, tt.maxPages, body, err, tt.want)
+		}
+		if got := strings.Join(fetched, " "); got != tt.fetched {
+			t.Errorf("%s=%q: fetched pages %q, want %q", maxPagesEnv, tt.maxPages, got, tt.fetched)
+		}
+	}
+}
+
+func TestLoadContentRevalidatesPages(t *testing.T) {
+	changed := map[string]bool{}
+	var fetched []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := r.URL.Query().Get("page")
+		if r.Header.Get("If-None-Match") != "" && !changed[n] {
+			fetched = append(fetched, n+":304")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fetched = append(fetched, n)
+		rev := "1"
+		if changed[n] {
+			rev = "2"
+		}
+		resp := map[string]any{
+			"hydra:member": []any{map[string]any{
+				"menuItems": []any{map[string]string{"rawHtml": "<p>page " + n + " v" + rev + "</p>"}},
+			}},
+		}
+		if n == "1" {
+			resp["hydra:view"] = map[string]string{"hydra:next": "/api/menus?page=2&type=photo-grafic"}
+		}
+		w.Header().Set("ETag", `"`+n+rev+`"`)
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer srv.Close()
+	redirect(t, srv)
+	t.Setenv(testFileEnv, "")
+	ctx := context.Background()
+
+	_, v, err := loadContent(ctx, State{})
+	if err != nil || len(v.Pages) != 2 {
+		t.Fatalf("first fetch: %+v, %v", v, err)
+	}
+	fetched = nil
+	if _, _, err := loadContent(ctx, State{Pages: v.Pages}); !errors.Is(err, errNotModified) {
+		t.Errorf("unchanged err = %v, want errNotModified", err)
+	}
+	if got := strings.Join(fetched, " "); got != "1:304 2:304" {
+		t.Errorf("unchanged fetched %q, want every page revalidated", got)
+	}
+
+	// Only page 2 changed: it is not skipped, and is not fetched twice.
+	changed["2"] = true
+	fetched = nil
+	body, v2, err := loadContent(ctx, State{Pages: v.Pages})
+	if err != nil || body != "<p>page 1 v1</p>\n<p>page 2 v2</p>" {
+		t.Fatalf("page 2 changed: %q, %v", body, err)
+	}
+	if got := strings.Join(fetched, " "); got != "1:304 2 1" {
+		t.Errorf("page 2 changed: fetched %q, want %q", got, "1:304 2 1")
+	}
+	if v2.Pages[1].ETag != `"22"` {
+		t.Errorf("page 2 validators = %+v", v2.Pages[1])
+	}
+}
+
+func TestNewTransport(t *testing.T) {
+	tests := []struct {
+		conns, timeout string
+		wantConns      int
+		wantTimeout    time.Duration
+		keepAlive      bool
+	}{
+		{"", "", defaultMaxIdlePerHost, defaultIdleConnTimeout, true},
+		{"4", "30s", 4, 30 * time.Second, true},
+		{"0", "", 0, defaultIdleConnTimeout, false},
+		{"-1", "soon", defaultMaxIdlePerHost, defaultIdleConnTimeout, true},
+	}
+	for _, tt := range tests {
+		t.Setenv(maxIdlePerHostEnv, tt.conns)
+		t.Setenv(idleConnTimeoutEnv, tt.timeout)
+		tr := newTransport()
+		if tr.MaxIdleConnsPerHost != tt.wantConns || tr.IdleConnTimeout != tt.wantTimeout || tr.DisableKeepAlives == tt.keepAlive {
+			t.Errorf("%q, %q: conns %d, timeout %s, keep-alive %v", tt.conns, tt.timeout, tr.MaxIdleConnsPerHost, tr.IdleConnTimeout, !tr.DisableKeepAlives)
+		}
+	}
+}
+
+func TestRepostImages(t *testing.T) {
+	var calls []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/bot") {
+			calls = append(calls, "GET "+r.URL.Path)
+			w.Write([]byte("image " + r.URL.Path))
+			return
+		}
+		r.ParseMultipartForm(1 << 20)
+		f, h, err := r.FormFile("photo")
+		if err != nil {
+			t.Errorf("%s: no photo: %v", r.URL.Path, err)
+			return
+		}
+		b, _ := io.ReadAll(f)
+		calls = append(calls, r.URL.Path+" "+h.Filename+" "+string(b)+" caption="+r.FormValue("caption"))
+	}))
+	defer srv.Close()
+	redirect(t, srv)
+	day := DayInfo{Date: "2025-12-12", Images: []string{"/media/a.png", "b.jpg?v=2"}}
+	n := telegramNotifier{token: "TOKEN", chatID: "-100"}
+	if err := n.Notify(context.Background(), day, "*графік на 12\\.12*\nграфік опубліковано зображенням"); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	// Relative sources resolve against the page the rawHtml is shown on;
+	// only the first photo carries the title.
+	want := []string{
+		"GET /media/a.png",
+		"/botTOKEN/sendPhoto a.png image /media/a.png caption=*графік на 12\\.12*",
+		"GET /b.jpg",
+		"/botTOKEN/sendPhoto b.jpg image /b.jpg caption=",
+	}
+	if strings.Join(calls, "\n") != strings.Join(want, "\n") {
+		t.Errorf("calls:\n%s\nwant:\n%s", strings.Join(calls, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestRepostImagesPartial(t *testing.T) {
+	var calls []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, r.URL.Path)
+		if r.URL.Path == "/b.jpg" {
+			http.Error(w, "gone", http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("image"))
+	}))
+	defer srv.Close()
+	redirect(t, srv)
+	day := DayInfo{Date: "2025-12-12", Images: []string{"/a.png", "/b.jpg"}}
+	n := telegramNotifier{token: "TOKEN", chatID: "-100"}
+	err := n.Notify(context.Background(), day, "*графік на 12\\.12*\nграфік опубліковано зображенням")
+	if err == nil || !strings.Contains(err.Error(), "image 2 of 2") {
+		t.Fatalf("Notify = %v, want image 2 of 2 error", err)
+	}
+	// The first picture is out, so no text message repeats it.
+	want := "/a.png /botTOKEN/sendPhoto /b.jpg"
+	if got := strings.Join(calls, " "); got != want {
+		t.Errorf("calls = %s, want %s", got, want)
+	}
+}
+
+func TestReportError(t *testing.T) {
+	var sent []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent = append(sent, r.URL.Path+" "+telegramPayload(t, r)["text"])
+	}))
+	defer srv.Close()
+	redirect(t, srv)
+	setEnv(t, map[string]string{
+		tokenEnv:     "SECRET",
+		errorChatEnv: "-300",
+		imageEnv:     "1", // alerts stay text messages
+		statePathEnv: filepath.Join(t.TempDir(), "state.json"),
+	})
+	runErr := errors.New(`Post "https://api.telegram.org/botSECRET/sendMessage": timeout`)
+	t0 := time.Date(2025, 12, 12, 9, 0, 0, 0, time.UTC)
+	for _, at := range []time.Time{t0, t0.Add(10 * time.Minute), t0.Add(59 * time.Minute), t0.Add(time.Hour)} {
+		reportError(runErr, at)
+	}
+	// One alert per POWERBOT_ERROR_INTERVAL (an hour by default).
+	want := "/botSECRET/sendMessage ⚠️ powerbot error:\n`Post \"https://api.telegram.org/bot***/sendMessage\": timeout`"
+	if len(sent) != 2 || sent[0] != want || sent[1] != want {
+		t.Errorf("sent %q, want twice %q", sent, want)
+	}
+}
+
+func TestMultipleChats(t *testing.T) {
+	var sent []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chat := telegramPayload(t, r)["chat_id"]
+		sent = append(sent, chat)
+		if chat == "-200" {
+			http.Error(w, `{"ok":false,"description":"Forbidden: bot was blocked by the user"}`, http.StatusForbidden)
+		}
+	}))
+	defer srv.Close()
+	redirect(t, srv)
+	setEnv(t, map[string]string{tokenEnv: "TOKEN", chatIDEnv: "-100, -200,,-300"})
+
+	var failed []string
+	for _, n := range loadNotifiers() {
+		if err := deliver(context.Background(), n, DayInfo{Date: "2025-12-12"}, "text"); err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	if got := strings.Join(sent, " "); got != "-100 -200 -300" {
+		t.Errorf("sent to %q, want one post per chat", got)
+	}
+	if len(failed) != 1 || !strings.HasPrefix(failed[0], "chat -200: ") {
+		t.Errorf("errors = %q, want one for chat -200", failed)
+	}
+}
+
+func TestPinAllDays(t *testing.T) {
+	kyiv, err := time.LoadLocation(kyivTZ)
+	if err != nil {
+		t.Skip(err)
+	}
+	outage := map[string]string{groupPower: "немає з 10:00 до 12:00"}
+	st := State{Days: []DayInfo{
+		day("2025-12-13", outage),
+		day("2025-12-11", outage),
+		day("2025-12-12", outage),
+		day("2025-12-15", outage),
+	}}
+	now := time.Date(2025, 12, 12, 9, 0, 0, 0, kyiv)
+	t.Setenv(pinAllDaysEnv, "1")
+
+	var dates []string
+	for _, d := range boardDays(st, now) {
+		dates = append(dates, d.Date)
+	}
+	if got := strings.Join(dates, " "); got != "2025-12-12 2025-12-13" {
+		t.Errorf("boardDays = %q, want today and tomorrow in order", got)
+	}
+	text := countdownText(st, now)
+	if !strings.HasPrefix(text, "*⏳ 12\\.12*\n") || !strings.Contains(text, "\n\n") || strings.Contains(text, "11\\.12") {
+		t.Errorf("countdownText =\n%s", text)
+	}
+	if i, j := strings.Index(text, "графік на 12\\.12"), strings.Index(text, "графік на 13\\.12"); i < 0 || j < i {
+		t.Errorf("countdownText lacks the day sections in order:\n%s", text)
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() { externalURL = "" }()
+	externalURL = "https://example.com/powerbot"
+	out := captureStderr(t, func() { err = serveMetrics(ctx, addr) })
+	if err != nil {
+		t.Fatalf("serveMetrics: %v", err)
+	}
+	// Behind a proxy, the log names the address scrapers actually use.
+	if !strings.Contains(out, "reachable as https://example.com/powerbot/metrics") {
+		t.Errorf("log = %q", out)
+	}
+	resp, err := http.Get("http://" + addr + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") || !strings.Contains(string(b), "powerbot_fetch_errors_total ") {
+		t.Errorf("/metrics = %s %q", resp.Header.Get("Content-Type"), b)
+	}
+	cancel()
+	// The listener closes once ctx is done.
+	for i := 0; ; i++ {
+		c, err := net.DialTimeout("tcp", addr, time.Second)
+		if err != nil {
+			break
+		}
+		c.Close()
+		if i == 50 {
+			t.Fatal("still serving after cancel")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCheckExternalURL(t *testing.T) {
+	tests := []struct {
+		in, want string
+		ok       bool
+	}{
+		{"https://bot.example.com", "https://bot.example.com", true},
+		{"https://bot.example.com/", "https://bot.example.com", true},
+		{"https://example.com/powerbot/", "https://example.com/powerbot", true},
+		{"http://bot.example.com", "", false},
+		{"bot.example.com", "", false},
+		{"/powerbot", "", false},
+		{"https://user:pw@bot.example.com", "", false},
+		{"https://bot.example.com/?x=1", "", false},
+		{"https://bot.example.com/#top", "", false},
+		{"https://bot.example.com/a//b", "", false},
+		{"https://bot.example.com/a/../b", "", false},
+	}
+	for _, tt := range tests {
+		got, err := checkExternalURL(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("checkExternalURL(%q) = %q, %v; want %q, ok %v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestLoadMaxIntervals(t *testing.T) {
+	day := day("2025-12-12", map[string]string{groupPower: "немає з 08:00 до 10:00, з 14:00 до 16:00"})
+	for _, tt := range []struct {
+		env  string
+		want int
+		warn bool
+	}{
+		{"", 0, false},
+		{"2", 2, false},
+		{"0", 0, true},
+		{"x", 0, true},
+	} {
+		t.Setenv(maxIntervalsEnv, tt.env)
+		var got int
+		logs := captureStderr(t, func() { got = loadMaxIntervals() })
+		if got != tt.want || strings.Contains(logs, "warning") != tt.warn {
+			t.Errorf("%q: got %d, log %q", tt.env, got, logs)
+		}
+	}
+	// The limit is passed in, so formatting never logs or reads the env.
+	t.Setenv(maxIntervalsEnv, "x")
+	var line string
+	if logs := captureStderr(t, func() { line = formatLine(day, groupPower, "💡", 1) }); logs != "" {
+		t.Errorf("formatLine logged %q", logs)
+	}
+	if want := "💡: немає з 08:00 до 10:00 \\(\\+1 ще\\)"; line != want {
+		t.Errorf("formatLine = %q, want %q", line, want)
+	}
+}
+
+func TestCheckParseHealth(t *testing.T) {
+	rec := &recorder{}
+	admin := recordingNotifier{r: rec, kind: "admin"}
+	ctx := context.Background()
+	t0 := time.Date(2025, 12, 12, 9, 0, 0, 0, time.UTC)
+	parsed := []DayInfo{day("2025-12-12", map[string]string{groupPower: "немає з 08:00 до 12:00"})}
+
+	st := checkParseHealth(ctx, State{}, nil, t0, admin)
+	if st.LastParsed == "" || len(rec.posts) != 0 {
+		t.Fatalf("first run: %+v, %d posts", st, len(rec.posts))
+	}
+	st = checkParseHealth(ctx, st, parsed, t0, admin)
+	for _, after := range []time.Duration{47 * time.Hour, 48 * time.Hour, 72 * time.Hour} {
+		st = checkParseHealth(ctx, st, nil, t0.Add(after), admin)
+	}
+	// Two days without a schedule alert once, however long it lasts.
+	if len(rec.posts) != 1 || !strings.Contains(rec.posts[0].Msg, "з 12\\.12 11:00") || !st.ParseAlerted {
+		t.Fatalf("posts %+v, alerted %v", rec.posts, st.ParseAlerted)
+	}
+	st = checkParseHealth(ctx, st, parsed, t0.Add(96*time.Hour), admin)
+	if st.ParseAlerted || st.LastParsed != t0.Add(96*time.Hour).Format(time.RFC3339) {
+		t.Errorf("after recovery: %+v", st)
+	}
+}
+
+func TestWeeklyAt(t *testing.T) {
+	tests := []struct {
+		v  string
+		wd time.Weekday
+		at time.Duration
+		ok bool
+	}{
+		{"", 0, 0, false},
+		{"sun 20:00", time.Sunday, 20 * time.Hour, true},
+		{"Friday 9:15", time.Friday, 9*time.Hour + 15*time.Minute, true},
+		{"MON  06:00", time.Monday, 6 * time.Hour, true},
+		{"sunday", 0, 0, false},
+		{"xyz 20:00", 0, 0, false},
+		{"sun 25:00", 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Setenv(weeklySummaryEnv, tt.v)
+		if wd, at, ok := weeklyAt(); wd != tt.wd || at != tt.at || ok != tt.ok {
+			t.Errorf("weeklyAt(%q) = %v, %v, %v; want %v, %v, %v", tt.v, wd, at, ok, tt.wd, tt.at, tt.ok)
+		}
+	}
+}
+
+func TestWeeklyText(t *testing.T) {
+	today := time.Date(2025, 12, 14, 0, 0, 0, 0, time.UTC)
+	parsed := []DayInfo{
+		day("2025-12-06", map[string]string{groupPower: "немає з 00:00 до 24:00"}),
+		day("2025-12-12", map[string]string{groupPower: "немає з 08:00 до 12:00"}),
+		day("2025-12-13", map[string]string{groupPower: "немає з 08:00 до 10:30", groupWater: schedule.AvailableText}),
+	}
+	st := recordTotals(State{}, parsed, today)
+	if _, ok := st.Totals["2025-12-06"]; ok {
+		t.Error("a day older than a week was kept")
+	}
+	want := "*підсумок тижня 08–14\\.12*\n💡 6\\.1: 6 год 30 хв\n💧 4\\.1: без відключень\n_дані є за 2 дн\\. з 7_"
+	if got := weeklyText(st, today, watched); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestPeriodicWeekly(t *testing.T) {
+	kyiv, err := time.LoadLocation(kyivTZ)
+	if err != nil {
+		t.Skip(err)
+	}
+	t.Setenv(weeklySummaryEnv, "sun 20:00")
+	rec := &recorder{}
+	notifiers := []Notifier{recordingNotifier{r: rec, kind: "post"}}
+	at := func(h, m int) time.Time { return time.Date(2025, 12, 14, h, m, 0, 0, kyiv) }
+	parsed := []DayInfo{day("2025-12-13", map[string]string{groupPower: "немає з 08:00 до 12:00"})}
+	st := recordTotals(State{}, parsed, startOfDay(at(9, 0)))
+	ctx := context.Background()
+
+	// No page is processed on these cycles: the summary is due by the clock.
+	st, err = periodic(ctx, st, at(19, 59), nil, notifiers)
+	if err != nil || len(rec.posts) != 0 {
+		t.Fatalf("before the hour: %d posts, %v", len(rec.posts), err)
+	}
+	st, err = periodic(ctx, st, at(20, 0), nil, notifiers)
+	if err != nil || len(rec.posts) != 1 || st.LastWeekly != "2025-12-14" {
+		t.Fatalf("at the hour: %d posts, last %q, %v", len(rec.posts), st.LastWeekly, err)
+	}
+	if _, err = periodic(ctx, st, at(21, 0), nil, notifiers); err != nil || len(rec.posts) != 1 {
+		t.Errorf("later that evening: %d posts, %v", len(rec.posts), err)
+	}
+}
+
+func TestStartOfDay(t *testing.T) {
+	utc := func(mo time.Month, d, h, m int) time.Time { return time.Date(2025, mo, d, h, m, 0, 0, time.UTC) }
+	tests := []struct {
+		name     string
+		fallback bool
+		now      time.Time
+		want     string
+	}{
+		{"before Kyiv midnight", true, utc(12, 12, 21, 59), "2025-12-12"},
+		{"Kyiv midnight", true, utc(12, 12, 22, 0), "2025-12-13"},
+		{"before UTC midnight", true, utc(12, 12, 23, 30), "2025-12-13"},
+		{"UTC midnight", true, utc(12, 13, 0, 0), "2025-12-13"},
+		// Without tzdata summer midnight comes an hour late.
+		{"summer, fixed UTC+2", true, utc(7, 12, 21, 30), "2025-07-12"},
+		{"summer, tzdata", false, utc(7, 12, 21, 30), "2025-07-13"},
+	}
+	defer func(saved func() (*time.Location, error)) { kyivZone = saved }(kyivZone)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loc, err := time.LoadLocation(kyivTZ)
+			kyivZone = func() (*time.Location, error) { return loc, err }
+			if tt.fallback {
+				kyivZone = func() (*time.Location, error) { return kyivFallback, errors.New("no tzdata") }
+			} else if err != nil {
+				t.Skip(err)
+			}
+			got := startOfDay(tt.now)
+			want, _ := time.ParseInLocation("2006-01-02", tt.want, kyivLocation())
+			if !got.Equal(want) {
+				t.Errorf("startOfDay(%s) = %s, want %s", tt.now.Format(time.RFC3339), got, want)
+			}
+		})
+	}
+}
+
+func TestImportState(t *testing.T) {
+	st := State{
+		Days: []DayInfo{day("2025-12-12", map[string]string{groupPower: "немає з 08:00 до 12:00"})},
+		Seen: map[string]map[string]string{"-100": {"2025-12-12": "abc"}},
+	}
+	dir := t.TempDir()
+	jsonPath, gobPath, backPath := filepath.Join(dir, "state.json"), filepath.Join(dir, "state.gob"), filepath.Join(dir, "back.json")
+	if err := saveState(jsonPath, st); err != nil {
+		t.Fatal(err)
+	}
+	// JSON -> gob -> JSON keeps everything.
+	t.Setenv(statePathEnv, gobPath)
+	if err := importState(jsonPath); err != nil {
+		t.Fatalf("import into gob: %v", err)
+	}
+	t.Setenv(statePathEnv, backPath)
+	if err := importState(gobPath); err != nil {
+		t.Fatalf("import back into JSON: %v", err)
+	}
+	got, err := loadState(backPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Version = stateVersion; !reflect.DeepEqual(got, st) {
+		t.Errorf("round trip = %+v\nwant %+v", got, st)
+	}
+	if err := importState(gobPath); err == nil {
+		t.Error("import overwrote an existing state file")
+	}
+	if err := importState(backPath); err == nil {
+		t.Error("imported the state file into itself")
+	}
+	os.WriteFile(filepath.Join(dir, "junk"), []byte("junk"), 0o644)
+	t.Setenv(statePathEnv, filepath.Join(dir, "new.json"))
+	if err := importState(filepath.Join(dir, "junk")); err == nil {
+		t.Error("imported a file that is neither JSON nor gob")
+	}
+}
+
+func TestKeepWindow(t *testing.T) {
+	st := State{
+		Days:      []DayInfo{{Date: "2025-12-10"}, {Date: "2025-12-11"}, {Date: "2025-12-12"}, {Date: "2025-12-13", Region: "kyiv"}},
+		Warned:    []string{"2025-12-10", "2025-12-13/kyiv"},
+		Escalated: []string{"2025-12-09"},
+		Posted:    map[string]string{"2025-12-10": "a", "2025-12-12": "b"},
+		Messages:  map[string]int{"2025-12-10/-100": 1, "2025-12-11/-100": 2},
+		Updates:   map[string]updateLog{"2025-12-10": {}, "2025-12-13/kyiv": {}},
+		Seen:      map[string]map[string]string{"1": {"2025-12-10": "a"}, "2": {"2025-12-10": "a", "2025-12-12": "b"}},
+	}
+	refs := []time.Time{time.Date(2025, 12, 12, 0, 0, 0, 0, time.UTC), time.Date(2025, 12, 13, 0, 0, 0, 0, time.UTC)}
+	got := keepWindow(st, refs)
+	var dates []string
+	for _, d := range got.Days {
+		dates = append(dates, dayKey(d))
+	}
+	checks := []struct {
+		name      string
+		got, want any
+	}{
+		{"days", dates, []string{"2025-12-11", "2025-12-12", "2025-12-13/kyiv"}},
+		{"warned", got.Warned, []string{"2025-12-13/kyiv"}},
+		{"escalated", got.Escalated, []string(nil)},
+		{"posted", got.Posted, map[string]string{"2025-12-12": "b"}},
+		{"messages", got.Messages, map[string]int{"2025-12-11/-100": 2}},
+		{"updates", got.Updates, map[string]updateLog{"2025-12-13/kyiv": {}}},
+		{"seen", got.Seen, map[string]map[string]string{"2": {"2025-12-12": "b"}}},
+	}
+	for _, c := range checks {
+		if !reflect.DeepEqual(c.got, c.want) {
+			t.Errorf("%s = %v, want %v", c.name, c.got, c.want)
+		}
+	}
+}
+
+func TestDumpHTML(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "dumps")
+	t.Setenv(dumpKeepEnv, "2")
+	t0 := time.Date(2025, 12, 12, 7, 0, 0, 0, time.UTC)
+	for i, body := range []string{"<p>one</p>", "<p>two</p>", "<p>three</p>"} {
+		if err := dumpHTML(dir, body, t0.Add(time.Duration(i)*time.Minute)); err != nil {
+			t.Fatalf("dumpHTML: %v", err)
+		}
+		if i == 0 {
+			os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("keep me"), 0o644)
+		}
+	}
+	entries, _ := os.ReadDir(dir)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	// The directory is created; the oldest dump went, other files stay.
+	if got := strings.Join(names, " "); got != "notes.txt powerbot-20251212-070100.000000000Z.html powerbot-20251212-070200.000000000Z.html" {
+		t.Fatalf("dir holds %s", got)
+	}
+	if b, _ := os.ReadFile(filepath.Join(dir, "powerbot-20251212-070200.000000000Z.html")); string(b) != "<p>three</p>" {
+		t.Errorf("latest dump = %q", b)
+	}
+}
+
+func TestRunNotModified(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotModified)
+	}))
+	defer srv.Close()
+	redirect(t, srv)
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	setEnv(t, map[string]string{testFileEnv: "", statePathEnv: statePath})
+	today := startOfDay(time.Now()).Format("2006-01-02")
+	saveState(statePath, State{
+		Days:     []DayInfo{{Date: "2020-01-01"}, {Date: today}},
+		Pages:    []pageCache{{URL: fetchURL, ETag: `"v1"`}},
+		PagesFor: windowKey(checkDates(startOfDay(time.Now()))),
+	})
+
+	// An unchanged page still runs the upkeep: the old day leaves the window.
+	if err := run(context.Background()); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	st, err := loadState(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(st.Days) != 1 || st.Days[0].Date != today {
+		t.Errorf("days = %+v, want only %s", st.Days, today)
+	}
+	if st.LastParsed == "" {
+		t.Error("parse health not checked on 304")
+	}
+}
+
+func TestRunWindowMoved(t *testing.T) {
+	loc, _ := time.LoadLocation(kyivTZ)
+	today := time.Now().In(loc)
+	fetches, posts := []string{}, 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/bot") {
+			posts++
+			w.Write([]byte(`{"ok":true,"result":{"message_id":1}}`))
+			return
+		}
+		if r.Header.Get("If-None-Match") != "" {
+			fetches = append(fetches, "304")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fetches = append(fetches, "200")
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(apiBody(`<p><b>Графік погодинних відключень на ` + today.Format("02.01.2006") + `</b></p>` +
+			`<p>Група 6.1. Електроенергії немає з 08:00 до 12:00.</p>`)))
+	}))
+	defer srv.Close()
+	redirect(t, srv)
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	setEnv(t, map[string]string{testFileEnv: "", statePathEnv: statePath, tokenEnv: "TOKEN", chatIDEnv: "42"})
+	// Yesterday's run saw today's schedule while today was past its window.
+	yesterday := startOfDay(time.Now()).AddDate(0, 0, -1)
+	saveState(statePath, State{
+		Pages:    []pageCache{{URL: fetchURL, ETag: `"v1"`}},
+		PagesFor: windowKey([]time.Time{yesterday}),
+	})
+
+	// The page is unchanged, but the window moved: it is processed again.
+	for range 2 {
+		if err := run(context.Background()); err != nil {
+			t.Fatalf("run: %v", err)
+		}
+	}
+	if got := strings.Join(fetches, " "); got != "200 304" || posts != 1 {
+		t.Errorf("fetches %q, %d posts; want a full fetch posting today, then a 304", got, posts)
+	}
+}
+
+func TestRunCorruptFetchFailed(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusBadGateway)
+	}))
+	defer srv.Close()
+	redirect(t, srv)
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	setEnv(t, map[string]string{testFileEnv: "", statePathEnv: statePath})
+	os.WriteFile(statePath, []byte(`{"days": [`), 0o644)
+
+	// Without a page to rebuild from, the corrupt file must stay as it is.
+	run(context.Background())
+	if b, _ := os.ReadFile(statePath); string(b) != `{"days": [` {
+		t.Errorf("state file now %q", b)
+	}
+}
+
+func TestSaveStateLocked(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	onDisk := State{
+		Subscriptions: map[string][]string{"42": {groupWater}},
+		Seen:          map[string]map[string]string{"42": {"2025-12-12": "bot"}, "-100": {"2025-12-12": "old"}},
+	}
+	if err := saveState(path, onDisk); err != nil {
+		t.Fatal(err)
+	}
+	run := State{Seen: map[string]map[string]string{"-100": {"2025-12-12": "new"}}}
+	if err := saveStateLocked(path, run); err != nil {
+		t.Fatal(err)
+	}
+	got, err := loadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.Subscriptions, onDisk.Subscriptions) {
+		t.Errorf("subscriptions = %v", got.Subscriptions)
+	}
+	want := map[string]map[string]string{"42": {"2025-12-12": "bot"}, "-100": {"2025-12-12": "new"}}
+	if !reflect.DeepEqual(got.Seen, want) {
+		t.Errorf("seen = %v, want %v", got.Seen, want)
+	}
+}
+
+func TestRegionSections(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		regions []string
+		bodies  []string
+	}{
+		{name: "no markers", body: "<p>a</p>", regions: []string{"lviv"}, bodies: []string{"<p>a</p>"}},
+		{
+			name:    "markers only",
+			body:    regionMarker("kyiv") + "k" + regionMarker("lviv") + "l",
+			regions: []string{"kyiv", "lviv"},
+			bodies:  []string{"k", "l"},
+		},
+		{
+			name:    "head is the default region",
+			body:    "h" + regionMarker("Київ  --  місто") + "k",
+			regions: []string{"lviv", "Київ - місто"},
+			bodies:  []string{"h", "k"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			regions, bodies := regionSections(tt.body, "lviv")
+			if !reflect.DeepEqual(regions, tt.regions) || !reflect.DeepEqual(bodies, tt.bodies) {
+				t.Errorf("got %q %q, want %q %q", regions, bodies, tt.regions, tt.bodies)
+			}
+		})
+	}
+}
+
+func TestFormatRun(t *testing.T) {
+	run := []DayInfo{
+		day("2025-12-12", map[string]string{groupPower: "немає з 08:00 до 12:00"}),
+		day("2025-12-13", map[string]string{groupPower: "немає з 08:00 до 12:00"}),
+	}
+	run[1].Updated = "2025-12-12T18:30:00Z"
+	notes := filepath.Join(t.TempDir(), "notes.json")
+	os.WriteFile(notes, []byte(`{"2025-12-13": "ремонт (планово)"}`), 0o644)
+	setEnv(t, map[string]string{notesFileEnv: notes, sourceAnchorEnv: "https://example.com/#{dm}"})
+	want := "*графік на 12–13\\.12*\n*💡 світла не буде*: немає з 08:00 до 12:00\n*💧 води не буде*: н/д" +
+		"\nремонт \\(планово\\)\n[відкрити графік на 12–13\\.12](https://example.com/#12.12)"
+	if got := formatRun(run, false, 0, nil, watched); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestPostRuns(t *testing.T) {
+	a := day("2025-12-12", map[string]string{groupPower: "немає з 08:00 до 12:00"})
+	b := day("2025-12-13", map[string]string{groupPower: "немає з 08:00 до 12:00"})
+	c := day("2025-12-14", map[string]string{groupPower: "немає з 09:00 до 12:00"})
+	other := b
+	other.Region = "kyiv"
+	tests := []struct {
+		name    string
+		combine string
+		pending []pendingPost
+		want    []int // run lengths
+	}{
+		{name: "off", pending: []pendingPost{{day: a}, {day: b}}, want: []int{1, 1}},
+		{name: "same schedule", combine: "1", pending: []pendingPost{{day: a}, {day: b}, {day: c}}, want: []int{2, 1}},
+		{name: "new and update", combine: "1", pending: []pendingPost{{day: a}, {day: b, update: true}}, want: []int{1, 1}},
+		{name: "both updates", combine: "1", pending: []pendingPost{{day: a, update: true}, {day: b, update: true, worse: 60}}, want: []int{2}},
+		{name: "cleared", combine: "1", pending: []pendingPost{{day: a, update: true}, {day: b, update: true, cleared: []string{groupWater}}}, want: []int{1, 1}},
+		{name: "other region", combine: "1", pending: []pendingPost{{day: a}, {day: other}}, want: []int{1, 1}},
+		{name: "gap", combine: "1", pending: []pendingPost{{day: a}, {day: day("2025-12-14", map[string]string{groupPower: "немає з 08:00 до 12:00"})}}, want: []int{1, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(combineDaysEnv, tt.combine)
+			var got []int
+			for _, run := range postRuns(tt.pending) {
+				got = append(got, len(run))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("runs = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}